@@ -1,213 +1,650 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
-	"net/url"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
-	"golang.org/x/net/html"
+	"strings"
+	"syscall"
+	"time"
+	"github.com/kieranvs/web-crawler/crawler"
 )
 
-/* Resource represents a page or file */
-type resource string;
+/* string_list is a flag.Value collecting every use of a repeatable flag */
+type string_list []string;
 
-/* PageLink represents a link from one Resource to another */
-type PageLink struct {
-	from resource;
-	to resource;
-}
+func (l *string_list) String() string { return strings.Join(*l, ", ") }
+func (l *string_list) Set(value string) error { *l = append(*l, value); return nil }
 
-/* ScrapeTask represents a link which needs to be followed by a worker */
-type ScrapeTask struct {
-	baseurl string;
-	page resource;
-	depth int;
+/* command_options are the settings of the command itself, as opposed to the crawl's Config */
+type command_options struct {
+	log_level slog.Level;
+	output_path string;
+	format OutputFormat;
+	stats_interval time.Duration; // 0 = no progress reports
+	checkpoint *Checkpointer;
+	max_output_depth int;
+	dry_run bool;
+	fail_on_error bool;
+	resume bool;
+	incremental bool; // crawl again, with conditional requests for the pages in the checkpoint
+	summary bool;
+	backlinks string; // url or path whose inbound links are printed once the output is written
+	max_duration time.Duration; // the crawl is stopped this long after it started, as if interrupted, 0 = no limit
 }
 
 func main() {
-	/* command line arguments */
+	config, cmd, err := NewConfigFromFlags();
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err);
+		os.Exit(2);
+	}
+
+	/* debug shows every page and why it was rejected, info only overall progress */
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cmd.log_level})));
+
+	/* cancelled on Ctrl+C or SIGTERM, after which the partial graph is written */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM);
+	if (cmd.max_duration > 0) {
+		var cancel context.CancelFunc;
+		ctx, cancel = context.WithTimeout(ctx, cmd.max_duration);
+		defer cancel();
+	}
+
+	if (cmd.dry_run) {
+		pages, err := crawler.DryRun(ctx, config);
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err);
+			os.Exit(2);
+		}
+		if (!print_dry_run(pages)) {
+			os.Exit(1);
+		}
+		os.Exit(0);
+	}
+
+	graph := new_graph();
+	if (cmd.resume) {
+		if err := load_checkpoint(cmd.checkpoint, graph); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot resume:", err);
+			os.Exit(2);
+		}
+		config.Stats.Edges.Store(int64(len(graph.edges)));
+		visited, pending := config.State.Snapshot();
+		slog.Info("Resuming crawl", "path", cmd.checkpoint.path, "visited", len(visited), "pending", len(pending));
+	}
+	if (cmd.incremental) {
+		previous, err := load_previous(cmd.checkpoint);
+		if (errors.Is(err, os.ErrNotExist)) {
+			slog.Info("No checkpoint to compare with yet, fetching every page", "path", cmd.checkpoint.path);
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot re-crawl:", err);
+			os.Exit(2);
+		} else {
+			config.Previous = previous;
+			slog.Info("Re-crawling, pages that have not changed are not downloaded again", "path", cmd.checkpoint.path, "pages", len(previous));
+		}
+	}
+
+	results, err := crawler.Crawl(ctx, config);
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err);
+		os.Exit(2);
+	}
+	if (config.Workers > max_sensible_workers) {
+		slog.Warn("Many workers, consider -delay to avoid overloading the target", "workers", config.Workers);
+	}
+	var consumer ResultConsumer = &GraphConsumer{graph: graph, output_path: cmd.output_path, write: cmd.format.write, stats: config.Stats, checkpoint: cmd.checkpoint, last_checkpoint: time.Now(), max_output_depth: cmd.max_output_depth};
+	var stream *NDJSONConsumer; // set when the results are written as they arrive, and the graph stays empty
+	if (cmd.format.stream) {
+		if stream, err = new_ndjson_consumer(cmd.output_path, config.Stats); err != nil {
+			slog.Error("Error writing output", "err", err);
+			os.Exit(1);
+		}
+		consumer = stream;
+	}
+	if (cmd.summary) {
+		consumer = new_summary_consumer(consumer);
+	}
+	written := make(chan error, 1); // the consumer's result once the output has been written
+	go func() { written <- consume_results(results, consumer) }();
+	if (cmd.stats_interval > 0) {
+		go stats_printer(config.Stats, cmd.stats_interval);
+	}
+
+	select {
+	case err = <- written:
+	case <- ctx.Done():
+		stop();
+		if (errors.Is(ctx.Err(), context.DeadlineExceeded)) {
+			slog.Warn("Stopping after -max-duration, finishing in-flight requests", "max_duration", cmd.max_duration);
+		} else {
+			slog.Warn("Interrupted, finishing in-flight requests (press Ctrl+C again to quit)");
+		}
+		err = <- written;
+	}
+	if (errors.Is(err, err_start_unreachable)) {
+		slog.Error("Nothing was crawled", "err", err);
+		os.Exit(1);
+	}
+	if err != nil {
+		slog.Error("Error writing output", "err", err);
+		os.Exit(1);
+	}
+	if (cmd.backlinks != "") {
+		/* with -output - stdout holds the results, so they are kept apart */
+		backlinks_out := io.Writer(os.Stdout);
+		if (cmd.output_path == "-") {
+			backlinks_out = os.Stderr;
+		}
+		print_backlinks(backlinks_out, graph, cmd.backlinks);
+	}
+	if (cmd.fail_on_error) {
+		n := count_broken(graph);
+		if (stream != nil) {
+			n = stream.broken;
+		}
+		if (n > 0) {
+			slog.Error("Broken links found", "count", n);
+			os.Exit(1);
+		}
+	}
+}
+
+/*
+Defines the command line flags and parses them into a validated Config for the crawl, and the settings of the command itself.
+The Config comes with its own Stats, and a State that a -resume checkpoint is loaded into.
+Returns an error describing the first flag that is invalid.
+*/
+func NewConfigFromFlags() (crawler.Config, command_options, error) {
 	worker_count := flag.Int("workers", 3, "Number of concurrent http requests");
-	target_base := flag.String("target", "http://localhost:8080", "Target base url e.g. http://website.com");
+	target_base := flag.String("target", "http://localhost:8080", "Target base url e.g. http://website.com, or a directory with -source file");
+	source := flag.String("source", "http", "Where pages come from: http, or file to crawl the html files in the -target directory");
 	target_page := flag.String("page", "/index.html", "Page to start at");
+	full_url := flag.String("url", "", "Full url of the page to start at instead of -target and -page, e.g. http://website.com/blog/ (may also be given as the only argument)");
+	cookies_path := flag.String("cookies", "", "File of cookies to send from the start, in Netscape cookies.txt format or name=value lines, e.g. a session exported from a browser");
+	sitemap := flag.String("sitemap", "", "Url of a sitemap.xml, sitemap index or .xml.gz, absolute or relative to -target, whose pages are the start pages instead of -page");
+	seeds_path := flag.String("seeds", "", "File of urls to start at instead of -page, one per line, absolute or relative to -target");
+	max_output_depth := flag.Int("max-output-depth", -1, "Leave pages found more than this many link hops from the start page out of the output (-1 = none)");
+	max_depth := flag.Int("max-depth", 1, "Link hops from the start page to crawl (0 = only the start page, -1 = unlimited)");
+	old_depth := flag.Int("depth", 2, "Deprecated, -depth N crawls the same pages as -max-depth N-1");
+	order := flag.String("order", "bfs", "Crawl order: bfs (finish each depth before the next) or dfs");
+	ignore_query := flag.Bool("ignore-query", false, "Drop query strings from links, treating urls that differ only in their query as the same page");
+	ignore_params := flag.String("ignore-query-params", "", "Comma separated query parameters to drop from links, e.g. utm_source,fbclid");
+	sort_query := flag.Bool("sort-query", false, "Treat urls whose query parameters differ only in order as the same page");
+	max_pages := flag.Int("maxpages", 0, "Stop queueing new pages once this many distinct pages have been queued (0 = unlimited)");
+	max_requests := flag.Int64("maxrequests", 0, "Stop sending requests after this many, counting redirects, retries, HEAD checks and robots.txt (0 = unlimited)");
+	max_redirects := flag.Int("max-redirects", 10, "Redirects to follow for one request before reporting it as \"Too many redirects\", 0 to report every redirect");
+	output_path := flag.String("output", "", "File to write the results to (default output.<ext> for the chosen format)");
+	stats_interval := flag.Int("stats-interval", 5, "Seconds between progress reports (0 = no progress reports)");
+	log_level := flag.String("loglevel", "info", "Log level: debug, info, warn or error");
+	springy_source := flag.String("springy-source", "local", "Where the springyjs output loads jQuery and SpringyJS from: local (written next to the output) or cdn");
+	format := flag.String("format", "springyjs", "Output format: springyjs, json, ndjson, dot, graphml, csv, adjacency, brokenlinks, timings, duplicates or sitemap");
+	timeout := flag.Int("timeout", 10, "HTTP request timeout in seconds (0 = no timeout)");
+	user_agent := flag.String("useragent", "kieranvs-web-crawler/1.0", "User-Agent header sent with every request");
+	accept := flag.String("accept", "text/html,application/xhtml+xml", "Accept header sent when fetching pages, empty to send none");
+	ignore_robots := flag.Bool("ignore-robots", false, "Do not fetch or obey robots.txt");
+	delay := flag.Int("delay", 0, "Minimum milliseconds between requests to the same host");
+	per_host_connections := flag.Int("per-host-connections", 0, "Most requests in flight to the same host at once, within the -workers (0 = no limit)");
+	delay_jitter := flag.Int("delay-jitter", 0, "Up to this many milliseconds added at random to each -delay, so requests are not evenly spaced");
+	username := flag.String("user", "", "Username for HTTP basic auth, sent only to allowed hosts");
+	password := flag.String("pass", "", "Password for HTTP basic auth");
+	proxy := flag.String("proxy", "", "Proxy url for all requests (default from HTTP_PROXY/HTTPS_PROXY)");
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification (dangerous, for internal sites only)");
+	max_bytes := flag.Int64("maxbytes", 5 << 20, "Largest page body in bytes to parse (0 = no limit)");
+	retries := flag.Int("retries", 2, "Times to retry a request after a connection error or 5xx response");
+	allowed_hosts := flag.String("allowed-hosts", "", "Comma separated list of extra hosts to crawl besides the target's");
+	include_subdomains := flag.Bool("include-subdomains", false, "Also crawl subdomains of the allowed hosts");
+	check_external := flag.Bool("check-external", false, "Check each link to another host with one HEAD request (GET if refused), reporting its status without crawling it");
+	record_external := flag.Bool("record-external", false, "Record links to other hosts without queueing them");
+	scan_js := flag.Bool("scan-js", false, "Record url-like string literals found in inline and external scripts (heuristic)");
+	var include, exclude, headers string_list;
+	flag.Var(&headers, "header", "Header sent with every request to the allowed hosts, as \"Name: Value\" (repeatable)");
+	flag.Var(&include, "include", "Only queue links whose url matches this regexp (repeatable)");
+	flag.Var(&exclude, "exclude", "Never queue links whose url matches this regexp (repeatable)");
+	crawl_css := flag.Bool("crawl-css", false, "Fetch linked stylesheets and record the url() references inside them");
+	checkpoint_path := flag.String("checkpoint", "", "File to periodically save the crawl to, so it can be continued with -resume");
+	backlinks := flag.String("backlinks", "", "After the crawl, print the pages that link to this url, or path on the target, e.g. a broken page");
+	max_duration := flag.Int("max-duration", 0, "Seconds after which the crawl stops and writes what it has found, as if interrupted (0 = no limit)");
+	checkpoint_interval := flag.Int("checkpoint-interval", 30, "Seconds between checkpoints (0 = only when the crawl ends)");
+	submit_buffer := flag.Int("submit-buffer", 0, "Capacity of the channel carrying discovered links from the workers to the queue");
+	results_buffer := flag.Int("results-buffer", 100, "Capacity of the channel carrying results from the workers to the output");
+	dry_run := flag.Bool("dry-run", false, "Fetch only the start page and print each link on it with whether it would be crawled");
+	fail_on_error := flag.Bool("fail-on-error", false, "Exit with status 1 if any page returned a 4xx/5xx status or could not be fetched");
+	summary := flag.Bool("summary", false, "Print a summary of the crawl to stderr when it ends: pages, links, status codes and time taken");
+	resume := flag.Bool("resume", false, "Continue the crawl saved in the -checkpoint file, skipping pages already visited");
+	incremental := flag.Bool("incremental", false, "Crawl again from the start, asking the server for each page in the -checkpoint file only if it changed since");
+	skip_extensions := flag.String("skip-extensions", default_skip_extensions, "Comma separated file extensions that are recorded as links but never fetched");
+	no_cookies := flag.Bool("no-cookies", false, "Do not keep cookies set by responses, send every request without them");
+	mirror := flag.String("mirror", "", "Directory to save a copy of every crawled html page in, as <dir>/<host>/<path>");
+	use_canonical := flag.Bool("use-canonical", false, "Treat a page that names another url with <link rel=\"canonical\"> as that page: merge their nodes and do not crawl the canonical url again");
+	detect_soft_404 := flag.Bool("detect-soft-404", false, "Fetch a missing page from each host and report pages that look like it as broken, for sites that answer missing pages with 200");
+	obey_meta_robots := flag.Bool("obey-meta-robots", false, "Obey <meta name=\"robots\">: do not crawl the links of nofollow pages and leave noindex pages out of the sitemap");
+	obey_nofollow := flag.Bool("obey-nofollow", false, "Record links with rel=\"nofollow\" as edges but do not crawl them");
+	follow_iframes := flag.Bool("follow-iframes", false, "Crawl the pages shown in <iframe>s, not only record them as links");
+	links := flag.Bool("links", true, "Record links from <a> and <area> as edges (they are crawled either way)");
+	images := flag.Bool("images", true, "Record <img> sources as edges");
+	scripts := flag.Bool("scripts", true, "Record <script> sources, and with -scan-js the urls found in scripts, as edges");
+	styles := flag.Bool("styles", true, "Record <link> hrefs, such as stylesheets and icons, as edges");
+	scope_prefix := flag.String("scope-prefix", "", "Only queue urls whose path starts with this prefix, e.g. /docs/ (others are recorded but not crawled)");
+	head_assets := flag.Bool("head-assets", false, "Check links to -skip-extensions files with a HEAD request, recording their status without downloading them");
 
 	flag.Parse();
 
-	/* program channels */
-	task_submit := make(chan ScrapeTask); //tasks submitted to the worker pool
-	task_queue := make(chan ScrapeTask); //tasks waiting to be retrieved by workers
-	task_done := make(chan int, 100); //notify on this channel when task is done
-	results := make(chan PageLink, 100); //result pagelinks to be processed
-
-	/* program components */
-	go unbounded_buffer(task_submit, task_queue, task_done, results);
-	for n := 0; n < *worker_count; n++ {
-		go scrape_worker(n, task_queue, results, task_submit, task_done)
+	if err := split_start_url(*full_url, target_base, target_page); err != nil {
+		return crawler.Config{}, command_options{}, err;
+	}
+	/* an absolute -sitemap url stands for -target, as a start url does */
+	if su, err := url.Parse(*sitemap); err == nil && su.Scheme != "" && su.Host != "" && !flag_set("target") && *full_url == "" && flag.NArg() == 0 {
+		*target_base = su.Scheme + "://" + su.Host;
 	}
-	go springyjs_printer(results);
 
-	task_submit <- ScrapeTask{baseurl: *target_base, page: resource(*target_page), depth: 0};
+	config := crawler.Config{
+		BaseURL: *target_base,
+		StartPage: *target_page,
+		Sitemap: *sitemap,
+		Source: *source,
+		Workers: *worker_count,
+		MaxDepth: *max_depth,
+		MaxPages: *max_pages,
+		MaxRequests: *max_requests,
+		MaxRedirects: *max_redirects,
+		NoRedirects: *max_redirects == 0,
+		Order: *order,
+		IgnoreQuery: *ignore_query,
+		IgnoreQueryParams: strings.Split(*ignore_params, ","),
+		SortQuery: *sort_query,
+		Timeout: time.Duration(*timeout) * time.Second,
+		UserAgent: *user_agent,
+		Accept: *accept,
+		IgnoreRobots: *ignore_robots,
+		Delay: time.Duration(*delay) * time.Millisecond,
+		DelayJitter: time.Duration(*delay_jitter) * time.Millisecond,
+		PerHostConnections: *per_host_connections,
+		Username: *username,
+		Password: *password,
+		Proxy: *proxy,
+		Insecure: *insecure,
+		MaxBytes: *max_bytes,
+		Retries: *retries,
+		AllowedHosts: strings.Split(*allowed_hosts, ","),
+		IncludeSubdomains: *include_subdomains,
+		RecordExternal: *record_external,
+		CheckExternal: *check_external,
+		CrawlCSS: *crawl_css,
+		ScanJS: *scan_js,
+		SkipExtensions: strings.Split(*skip_extensions, ","),
+		HeadAssets: *head_assets,
+		ScopePrefix: *scope_prefix,
+		FollowIframes: *follow_iframes,
+		ObeyNofollow: *obey_nofollow,
+		ObeyMetaRobots: *obey_meta_robots,
+		DetectSoft404: *detect_soft_404,
+		UseCanonical: *use_canonical,
+		Mirror: *mirror,
+		NoCookies: *no_cookies,
+		NoLinkEdges: !*links,
+		NoImageEdges: !*images,
+		NoScriptEdges: !*scripts,
+		NoStyleEdges: !*styles,
+		SubmitBuffer: *submit_buffer,
+		ResultsBuffer: *results_buffer,
+		Stats: &crawler.CrawlStats{},
+		State: crawler.NewCrawlState(),
+	};
+	cmd := command_options{
+		output_path: *output_path,
+		stats_interval: time.Duration(*stats_interval) * time.Second,
+		checkpoint: &Checkpointer{path: *checkpoint_path, interval: time.Duration(*checkpoint_interval) * time.Second, target: *target_base, state: config.State},
+		max_output_depth: *max_output_depth,
+		dry_run: *dry_run,
+		fail_on_error: *fail_on_error,
+		resume: *resume,
+		incremental: *incremental,
+		summary: *summary,
+		max_duration: time.Duration(*max_duration) * time.Second,
+		backlinks: *backlinks,
+	};
 
-	select {}
+	if err := cmd.log_level.UnmarshalText([]byte(*log_level)); err != nil {
+		return config, cmd, fmt.Errorf("unknown log level: %s", *log_level);
+	}
+	format_ok := false;
+	if cmd.format, format_ok = output_formats[*format]; !format_ok {
+		return config, cmd, fmt.Errorf("unknown output format: %s", *format);
+	}
+	if _, ok := springy_scripts[*springy_source]; !ok {
+		return config, cmd, fmt.Errorf("unknown -springy-source: %s", *springy_source);
+	}
+	if (*format == "springyjs") {
+		cmd.format.write = springyjs_writer(*springy_source);
+	}
+	if (cmd.output_path == "") {
+		cmd.output_path = "output." + cmd.format.extension;
+	}
+	if (flag_set("depth")) {
+		if (flag_set("max-depth")) {
+			return config, cmd, errors.New("-depth and -max-depth cannot be used together, use -max-depth");
+		}
+		/* -depth counted the pages fetched along a path rather than the hops, 0 meant the same as 1 and a negative depth unlimited */
+		config.MaxDepth = *old_depth - 1;
+		if (*old_depth == 0) {
+			config.MaxDepth = 0;
+		} else if (*old_depth < 0) {
+			config.MaxDepth = -1;
+		}
+	}
+	if (*max_redirects < 0) {
+		return config, cmd, errors.New("-max-redirects cannot be negative");
+	}
+	if (cmd.max_duration < 0) {
+		return config, cmd, errors.New("-max-duration cannot be negative");
+	}
+	if (cmd.resume && cmd.checkpoint.path == "") {
+		return config, cmd, errors.New("-resume needs the -checkpoint file to resume from");
+	}
+	if (cmd.incremental && (cmd.resume || cmd.checkpoint.path == "")) {
+		return config, cmd, errors.New("-incremental needs the -checkpoint file of the last crawl, and cannot be used with -resume");
+	}
+	if (cmd.format.stream && (cmd.checkpoint.path != "" || cmd.backlinks != "" || cmd.max_output_depth >= 0)) {
+		return config, cmd, errors.New("-format ndjson keeps no graph, so it cannot be used with -checkpoint, -backlinks or -max-output-depth");
+	}
+	var err error;
+	if config.Include, err = compile_patterns("include", include); err != nil {
+		return config, cmd, err;
+	}
+	if config.Exclude, err = compile_patterns("exclude", exclude); err != nil {
+		return config, cmd, err;
+	}
+	if (*seeds_path != "") {
+		if config.Seeds, err = read_seeds(*seeds_path); err != nil {
+			return config, cmd, fmt.Errorf("invalid -seeds: %v", err);
+		}
+	}
+	if config.Header, err = parse_headers(headers); err != nil {
+		return config, cmd, err;
+	}
+	if (*cookies_path != "") {
+		if config.Cookies, err = read_cookies(*cookies_path); err != nil {
+			return config, cmd, fmt.Errorf("invalid -cookies: %v", err);
+		}
+	}
+	return config, cmd, config.Validate();
 }
 
 /*
-Unbounded queue of ScrapeTasks between input and output.
-Removes duplicate tasks for same page.
-Keeps track of the number of delegated tasks and closes results channel when done.
+Reads the cookies in path, either a Netscape cookies.txt as exported by browser extensions and curl,
+with seven tab separated fields per line, or lines of name=value pairs separated by ; as in a Cookie header.
+Cookies in the simple format have no domain, so they are sent to the -target host only.
 */
-func unbounded_buffer(input chan ScrapeTask, output chan ScrapeTask, task_done chan int, results chan PageLink) {
-	queue := []ScrapeTask{};
-	done := make(map[resource]bool);
-	unfinished := 0;
-	started := false;
-
-	for {
-		if (len(queue) == 0 && unfinished == 0 && started) {
-			close(results);
-		}
-		if (len(queue) == 0) {
-			select {
-			case d := <- input:
-				if (!done[d.page]) {
-					done[d.page] = true;
-					queue = append(queue, d);
-					unfinished += 1;
-					started = true;
-				}
-			case <- task_done:
-				unfinished -= 1;
+func read_cookies(path string) ([]*http.Cookie, error) {
+	f, err := os.Open(path);
+	if err != nil {
+		return nil, err;
+	}
+	defer f.Close();
+
+	cookies := []*http.Cookie{};
+	scanner := bufio.NewScanner(f);
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text());
+		http_only := strings.HasPrefix(text, "#HttpOnly_");
+		text = strings.TrimPrefix(text, "#HttpOnly_");
+		if (text == "" || strings.HasPrefix(text, "#")) {
+			continue;
+		}
+		if fields := strings.Split(text, "\t"); len(fields) == 7 {
+			/* domain, include subdomains, path, secure, expiry in unix seconds (0 for a session cookie), name, value */
+			c := &http.Cookie{Domain: fields[0], Path: fields[2], Secure: strings.EqualFold(fields[3], "TRUE"), Name: fields[5], Value: fields[6], HttpOnly: http_only};
+			if expiry, err := strconv.ParseInt(fields[4], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid expiry %q", line, fields[4]);
+			} else if (expiry > 0) {
+				c.Expires = time.Unix(expiry, 0);
 			}
-		} else {
-			select {
-			case d := <- input:
-				if (!done[d.page]) {
-					done[d.page] = true;
-					queue = append(queue, d);
-					unfinished += 1;
-				}
-			case output <- queue[0]:
-				queue = queue[1:];
-			case <- task_done:
-				unfinished -= 1;
+			cookies = append(cookies, c);
+			continue;
+		}
+		for _, pair := range strings.Split(text, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=");
+			if (!ok || strings.TrimSpace(name) == "") {
+				return nil, fmt.Errorf("line %d: expected name=value or 7 tab separated fields", line);
 			}
+			cookies = append(cookies, &http.Cookie{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)});
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err;
+	}
+	if (len(cookies) == 0) {
+		return nil, fmt.Errorf("%s has no cookies", path);
+	}
+	return cookies, nil;
 }
 
 /*
-Scrape Workers take tasks from the task_queue, scrape the page, adding results to results and newly discovered pages to task_submit. Signals on task_done when the task is done to facilitate clean program termination.
+Sets base and page from a full start url, given as -url or as the only argument, e.g. http://website.com/blog/?p=2
+gives the base http://website.com and the page /blog/?p=2. Without one they keep their -target and -page values.
 */
-func scrape_worker(worker_id int, task_queue chan ScrapeTask, results chan PageLink, task_submit chan ScrapeTask, task_done chan int) {
-	for {
-		task := <- task_queue;
-		if(task.depth < 2) {
-			task_status := scrape(task, results, task_submit);
-			fmt.Println("Worker", worker_id, ":", task_status, "[", string(task.page), "]");
+func split_start_url(full_url string, base *string, page *string) error {
+	if (flag.NArg() > 1) {
+		return fmt.Errorf("expected at most one url argument, got %d", flag.NArg());
+	}
+	if (flag.NArg() == 1) {
+		if (full_url != "") {
+			return errors.New("give the url either as -url or as an argument, not both");
 		}
-		task_done <- 0;
+		full_url = flag.Arg(0);
+	}
+	if (full_url == "") {
+		return nil;
 	}
+	if (flag_set("target") || flag_set("page")) {
+		return errors.New("a full url replaces -target and -page, they cannot be used with it");
+	}
+	u, err := url.Parse(full_url);
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid start url %s, expected a full url such as http://website.com/", full_url);
+	}
+	*base = u.Scheme + "://" + u.Host;
+	*page = u.RequestURI();
+	return nil;
 }
 
-func scrape(task ScrapeTask, results chan PageLink, task_submit chan ScrapeTask) string {
-	newurl := fix_url(string(task.baseurl), string(task.page));
+/* Parses -header values of the form "Name: Value", a header given more than once is sent with each value */
+func parse_headers(values []string) (http.Header, error) {
+	header := make(http.Header);
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, ":");
+		name = strings.TrimSpace(name);
+		if (!ok || name == "" || strings.ContainsAny(name, " \t")) {
+			return nil, fmt.Errorf("invalid -header %q, expected \"Name: Value\"", v);
+		}
+		header.Add(name, strings.TrimSpace(value));
+	}
+	return header, nil;
+}
+
+/* Reads the seed urls from path, skipping blank lines and # comments */
+func read_seeds(path string) ([]string, error) {
+	f, err := os.Open(path);
+	if err != nil {
+		return nil, err;
+	}
+	defer f.Close();
 
-	u, _ := url.Parse(newurl);
-	bu, _ := url.Parse(task.baseurl);
-	if(u.Host != bu.Host) {
-		return "Rejected due to hostname=" + string(u.Host);
+	seeds := []string{};
+	scanner := bufio.NewScanner(f);
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text());
+		if (text == "" || strings.HasPrefix(text, "#")) {
+			continue;
+		}
+		seeds = append(seeds, text);
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err;
 	}
-	if(u.Scheme != "http" && u.Scheme != "https") {
-		return "Rejected due to scheme=" + string(u.Scheme);
+	if (len(seeds) == 0) {
+		return nil, fmt.Errorf("%s has no urls", path);
 	}
+	return seeds, nil;
+}
 
-	resp, err := http.Get(newurl);
-	if err != nil {
-    	return "HTTP error";
-	}
-	contentType := resp.Header.Get("Content-Type");
-	if(len(contentType) < 11 || contentType[0:10] != "text/html;") {
-		return "Rejected due to content-type=" + contentType;
-	}
-
-	z := html.NewTokenizer(resp.Body)
-
-	defer resp.Body.Close()
-
-	for {
-	    tt := z.Next()
-
-	    switch {
-	    case tt == html.ErrorToken:
-	    	return "Done";
-	    case tt == html.StartTagToken:
-	        t := z.Token()
-
-	        if t.Data == "a" {
-	            for _, a := range t.Attr {
-				    if a.Key == "href" {
-				    	pl := PageLink{from: task.page, to: resource(a.Val)};
-				    	st := ScrapeTask{baseurl: task.baseurl, page: resource(a.Val), depth: task.depth + 1};
-				    	task_submit <- st;
-				        results <- pl;
-				        break
-				    }
-				}
-	        }
-	        if t.Data == "link" {
-	        	for _, a := range t.Attr {
-	        		if a.Key == "href" {
-	        			pl := PageLink{from: task.page, to: resource(a.Val)};
-	        			results <- pl;
-	        		}
-	        	}
-	        }
-	        if t.Data == "script" {
-	        	for _, a := range t.Attr {
-	        		if a.Key == "src" {
-	        			pl := PageLink{from: task.page, to: resource(a.Val)};
-	        			results <- pl;
-	        		}
-	        	}
-	        }
-	    case tt == html.SelfClosingTagToken:
-	    	t := z.Token();
-	    	if t.Data == "img" {
-	        	for _, a := range t.Attr {
-	        		if a.Key == "src" {
-	        			pl := PageLink{from: task.page, to: resource(a.Val)};
-	        			results <- pl;
-	        		}
-	        	}
-	        }
-	    }
-	}
-}
-
-func fix_url(baseurl string, relurl string) string {
-	u, _ := url.Parse(relurl)
-    base, _ := url.Parse(baseurl)
-    return base.ResolveReference(u).String()
-}
-
-/* Results consumer for debugging */
-func simple_printer(input chan PageLink) {
-	for {
-		val := <- input;
-		fmt.Println(val.from, " -> ", val.to);
+/* Reports whether the named flag was given on the command line */
+func flag_set(name string) bool {
+	set := false;
+	flag.Visit(func(f *flag.Flag) {
+		if (f.Name == name) {
+			set = true;
+		}
+	});
+	return set;
+}
+
+/* More workers than this are likely to overload a site, or to be a typo */
+const max_sensible_workers = 100;
+
+/* Binary and media files that cannot contain links worth following */
+const default_skip_extensions = "pdf,zip,gz,tgz,tar,rar,7z,exe,dmg,iso,jpg,jpeg,png,gif,webp,bmp,ico,tif,tiff,mp3,mp4,m4a,wav,ogg,avi,mov,mkv,webm,woff,woff2,ttf,otf,eot";
+
+/* Compiles the regexps given with a repeatable flag */
+func compile_patterns(flag_name string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{};
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern);
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s pattern: %v", flag_name, err);
+		}
+		compiled = append(compiled, re);
+	}
+	return compiled, nil;
+}
+
+/* Logs the crawl's progress every interval */
+func stats_printer(stats *crawler.CrawlStats, interval time.Duration) {
+	ticker := time.NewTicker(interval);
+	defer ticker.Stop();
+	for range ticker.C {
+		slog.Info("Progress",
+			"crawled", stats.Crawled.Load(),
+			"queued", stats.Queued.Load(),
+			"in_flight", stats.InFlight.Load(),
+			"edges", stats.Edges.Load());
+	}
+}
+
+/*
+ResultConsumer processes everything the workers send on the results channel.
+Consume is called for each result in order, then Finish once the channel is closed.
+*/
+type ResultConsumer interface {
+	Consume(val crawler.PageLink);
+	Finish() error;
+}
+
+/* Feeds the results to consumer until the channel is closed, returning Finish's error */
+func consume_results(input <-chan crawler.PageLink, consumer ResultConsumer) error {
+	for val := range input {
+		consumer.Consume(val);
+	}
+	return consumer.Finish();
+}
+
+/* Results consumer for debugging, prints each link as it is found */
+type SimplePrinter struct{}
+
+func (p SimplePrinter) Consume(val crawler.PageLink) {
+	if (val.Report == nil) {
+		fmt.Println(val.From, " -> ", val.To);
 	}
 }
 
+func (p SimplePrinter) Finish() error { return nil }
+
+/*
+SummaryConsumer passes the results on to next, tallying them as they go by,
+and prints a summary of the crawl to stderr once next has finished.
+*/
+type SummaryConsumer struct {
+	next ResultConsumer;
+	start time.Time;
+	pages int;
+	broken int;
+	links map[[2]crawler.Resource]bool; // distinct from, to pairs
+	external map[string]bool; // distinct urls on other hosts
+	codes map[int]int; // pages by HTTP status code, 0 for no response
+}
+
+func new_summary_consumer(next ResultConsumer) *SummaryConsumer {
+	return &SummaryConsumer{next: next, start: time.Now(), links: make(map[[2]crawler.Resource]bool), external: make(map[string]bool), codes: make(map[int]int)};
+}
+
+func (c *SummaryConsumer) Consume(val crawler.PageLink) {
+	if (val.Report != nil) {
+		c.pages += 1;
+		c.codes[val.Report.Code] += 1;
+		if (crawler.IsBroken(val.Report)) {
+			c.broken += 1;
+		}
+	} else {
+		c.links[[2]crawler.Resource{val.From, val.To}] = true;
+		if (val.External) {
+			c.external[val.URL] = true;
+		}
+	}
+	c.next.Consume(val);
+}
+
+func (c *SummaryConsumer) Finish() error {
+	err := c.next.Finish();
+
+	codes := []int{};
+	for code := range c.codes {
+		codes = append(codes, code);
+	}
+	sort.Ints(codes);
+
+	fmt.Fprintln(os.Stderr, "Crawl summary");
+	fmt.Fprintf(os.Stderr, "  %-16s %d\n", "pages crawled", c.pages);
+	fmt.Fprintf(os.Stderr, "  %-16s %d\n", "unique links", len(c.links));
+	fmt.Fprintf(os.Stderr, "  %-16s %d\n", "external links", len(c.external));
+	fmt.Fprintf(os.Stderr, "  %-16s %d\n", "broken links", c.broken);
+	for _, code := range codes {
+		label := "status " + strconv.Itoa(code);
+		if (code == 0) {
+			label = "no response";
+		}
+		fmt.Fprintf(os.Stderr, "  %-16s %d\n", label, c.codes[code]);
+	}
+	fmt.Fprintf(os.Stderr, "  %-16s %s\n", "elapsed", time.Since(c.start).Round(time.Millisecond));
+	return err;
+}
+
 
 /*
 
 ==================================
 
-Pretty printing in graph form using SpringyJS
+Output of the link graph
 
-springyjs_printer consumes the results and builds a graph.
-When the results channel is closed, it writes output.html to draw the graph using SpringyJS.
+GraphConsumer consumes the results and builds a graph.
+When the results channel is closed, it writes the graph using the writer for the chosen -format.
 
 */
 
@@ -220,48 +657,548 @@ func contains(value string, list []string) bool {
     return false
 }
 
-func insertEdge(from string, to string, list *[]PageLinkEdge) {
-    for i, v := range *list {
-        if (v.from == from && v.to == to) {
-            (*list)[i].count += 1;
-            return;
+/* Returns the number of distinct links on each page, pages without any are left out */
+func out_degrees(graph *Graph) map[string]int {
+	degrees := make(map[string]int);
+	for _, e := range graph.edges {
+		degrees[e.from] += 1;
+	}
+	return degrees;
+}
+
+/* Records that node was found depth link hops from the start page, keeping the fewest */
+func set_depth(graph *Graph, node string, depth int) {
+	if d, ok := graph.depths[node]; !ok || depth < d {
+		graph.depths[node] = depth;
+	}
+}
+
+/*
+Returns the part of the graph within max_depth link hops of the start page: the nodes found that close,
+the edges between them and the reports of those pages. A negative max_depth returns the graph itself.
+*/
+func within_output_depth(graph *Graph, max_depth int) *Graph {
+	if (max_depth < 0) {
+		return graph;
+	}
+	kept := func(node string) bool {
+		d, ok := graph.depths[node];
+		return ok && d <= max_depth;
+	};
+	out := new_graph();
+	out.titles = graph.titles;
+	out.depths = graph.depths;
+	for _, n := range graph.nodes {
+		if (kept(n)) {
+			insertNode(n, out);
+		}
+	}
+	for _, e := range graph.edges {
+		if (kept(e.from) && kept(e.to)) {
+			out.edge_index[edge_key{from: e.from, to: e.to}] = len(out.edges);
+			out.edges = append(out.edges, e);
+		}
+	}
+	for _, r := range graph.reports {
+		if (r.Depth <= max_depth) {
+			out.reports = append(out.reports, r);
+		}
+	}
+	return out;
+}
+
+/* Adds a node the first time it is seen */
+func insertNode(node string, graph *Graph) {
+    if _, ok := graph.node_set[node]; ok {
+        return;
+    }
+    graph.node_set[node] = struct{}{};
+    graph.nodes = append(graph.nodes, node);
+}
+
+/* Counts a link from one node to another, adding the edge the first time it is seen, which also fixes its kind */
+func insertEdge(from string, to string, url string, text string, kind string, graph *Graph) {
+    key := edge_key{from: from, to: to};
+    if i, ok := graph.edge_index[key]; ok {
+        graph.edges[i].count += 1;
+        if (graph.edges[i].text == "") {
+            graph.edges[i].text = text;
         }
+        return;
     }
-    *list = append(*list, PageLinkEdge{from: from, to: to, count: 1});
+    graph.edge_index[key] = len(graph.edges);
+    graph.edges = append(graph.edges, PageLinkEdge{from: from, to: to, url: url, text: text, kind: kind, count: 1});
 }
 
 type PageLinkEdge struct {
 	from string;
 	to string;
+	url string; // absolute url of to
+	text string; // the first non-empty link text seen for it
+	kind string; // crawler.PageLink.Kind of the first link seen, e.g. "anchor" or "image"
 	count int;
 }
 
-func springyjs_printer(input chan PageLink) {
-	nodes := []string{};
-	edges := []PageLinkEdge{};
-	for val := range input {
-		if(!contains(string(val.from), nodes)) {
-			nodes = append(nodes, string(val.from));
+type edge_key struct {
+	from string;
+	to string;
+}
+
+/* Graph is everything GraphConsumer accumulates from the results channel */
+type Graph struct {
+	nodes []string; // in the order first seen
+	node_set map[string]struct{}; // the same nodes, for membership tests
+	edges []PageLinkEdge; // in the order first seen
+	edge_index map[edge_key]int; // position of each edge in edges
+	reports []*crawler.PageReport;
+	titles map[string]string; // node to page title, for pages that have one
+	depths map[string]int; // node to the fewest link hops from the start page it was found at
+	pages map[string]json_page; // pages loaded from a checkpoint by url, saved again with those fetched since
+	aliases map[string]string; // with -use-canonical, pages merged into the canonical page they named
+}
+
+/* Writes the accumulated graph to output_path */
+type graph_writer func(output_path string, graph *Graph) error;
+
+type OutputFormat struct {
+	extension string; // used for the default output file name
+	write graph_writer;
+	stream bool; // written line by line as the results arrive by an NDJSONConsumer instead of with write
+}
+
+var output_formats = map[string]OutputFormat{
+	"springyjs": {extension: "html", write: springyjs_writer("local")},
+	"json": {extension: "json", write: write_json},
+	"dot": {extension: "dot", write: write_dot},
+	"csv": {extension: "csv", write: write_csv},
+	"brokenlinks": {extension: "txt", write: write_brokenlinks},
+	"timings": {extension: "txt", write: write_timings},
+	"duplicates": {extension: "txt", write: write_duplicates},
+	"sitemap": {extension: "xml", write: write_sitemap},
+	"graphml": {extension: "graphml", write: write_graphml},
+	"adjacency": {extension: "txt", write: write_adjacency},
+	"ndjson": {extension: "ndjson", stream: true},
+};
+
+func new_graph() *Graph {
+	return &Graph{nodes: []string{}, node_set: make(map[string]struct{}), edges: []PageLinkEdge{}, edge_index: make(map[edge_key]int), titles: make(map[string]string), depths: make(map[string]int), pages: make(map[string]json_page), aliases: make(map[string]string)};
+}
+
+/* Adds a result to the graph, either a fetch report or a link */
+func add_result(graph *Graph, val crawler.PageLink) {
+	if (val.Report != nil) {
+		graph.reports = append(graph.reports, val.Report);
+		if (val.Report.Canonical != "") {
+			merge_node(graph, string(val.Report.Final), string(val.Report.Canonical));
 		}
-		if(!contains(string(val.to), nodes)) {
-			nodes = append(nodes, string(val.to));
+		final := node_name(graph, string(val.Report.Final));
+		if (val.Report.Title != "") {
+			graph.titles[final] = val.Report.Title;
 		}
-		insertEdge(string(val.from), string(val.to), &edges);
+		set_depth(graph, node_name(graph, string(val.Report.Page)), val.Report.Depth);
+		set_depth(graph, final, val.Report.Depth);
+		return;
 	}
+	from, to := node_name(graph, string(val.From)), node_name(graph, string(val.To));
+	insertNode(from, graph);
+	insertNode(to, graph);
+	set_depth(graph, to, val.Depth);
+	insertEdge(from, to, val.URL, val.Text, val.Kind, graph);
+}
+
+/* Returns the node a page is drawn as, which is its canonical page once it has been merged into one */
+func node_name(graph *Graph, page string) string {
+	if canonical, ok := graph.aliases[page]; ok {
+		return canonical;
+	}
+	return page;
+}
 
-	fmt.Println("Writing to output.html");
-	f, _ := os.Create("/Users/Kieran/Desktop/crawler/output.html");
-	f.WriteString("<html>\n<body>\n<script src=\"http://ajax.googleapis.com/ajax/libs/jquery/1.3.2/jquery.min.js\"></script>\n<script src=\"springy.js\"></script>\n<script src=\"springyui.js\"></script>\n<script>\nvar graph = new Springy.Graph();\n");
+/*
+Merges the node of a page into the node of the canonical page it named, which takes over its edges, title and depth.
+Edges that become the same are counted together, the first keeping its place, text and kind.
+*/
+func merge_node(graph *Graph, page string, canonical string) {
+	canonical = node_name(graph, canonical);
+	if (page == canonical || graph.aliases[page] != "") {
+		return;
+	}
+	graph.aliases[page] = canonical;
+	for p, c := range graph.aliases {
+		if (c == page) {
+			graph.aliases[p] = canonical;
+		}
+	}
+	if _, ok := graph.node_set[page]; !ok {
+		return;
+	}
 
+	nodes := graph.nodes;
+	graph.nodes, graph.node_set = []string{}, make(map[string]struct{});
 	for _, n := range nodes {
-		f.WriteString("graph.addNodes('" + n + "');\n");
+		insertNode(node_name(graph, n), graph);
+	}
+	edges := graph.edges;
+	graph.edges, graph.edge_index = []PageLinkEdge{}, make(map[edge_key]int);
+	for _, e := range edges {
+		e.from, e.to = node_name(graph, e.from), node_name(graph, e.to);
+		if i, ok := graph.edge_index[edge_key{from: e.from, to: e.to}]; ok {
+			graph.edges[i].count += e.count;
+			if (graph.edges[i].text == "") {
+				graph.edges[i].text = e.text;
+			}
+			continue;
+		}
+		graph.edge_index[edge_key{from: e.from, to: e.to}] = len(graph.edges);
+		graph.edges = append(graph.edges, e);
+	}
+	if title, ok := graph.titles[page]; ok {
+		if _, ok := graph.titles[canonical]; !ok {
+			graph.titles[canonical] = title;
+		}
+		delete(graph.titles, page);
+	}
+	if d, ok := graph.depths[page]; ok {
+		set_depth(graph, canonical, d);
+		delete(graph.depths, page);
+	}
+}
+
+/*
+GraphConsumer builds the graph from the results, starting from graph (which is non-empty when resuming),
+and saves checkpoints while it does. Finish writes the output with the writer for the chosen -format.
+*/
+type GraphConsumer struct {
+	graph *Graph;
+	output_path string;
+	write graph_writer;
+	stats *crawler.CrawlStats;
+	checkpoint *Checkpointer;
+	last_checkpoint time.Time;
+	max_output_depth int; // nodes found further from the start page are left out of the output, -1 = none
+}
+
+func (c *GraphConsumer) Consume(val crawler.PageLink) {
+	add_result(c.graph, val);
+	c.stats.Edges.Store(int64(len(c.graph.edges)));
+
+	if (c.checkpoint.path != "" && c.checkpoint.interval > 0 && time.Since(c.last_checkpoint) >= c.checkpoint.interval) {
+		c.save_checkpoint();
+	}
+}
+
+func (c *GraphConsumer) Finish() error {
+	if (c.checkpoint.path != "") {
+		c.save_checkpoint();
+	}
+	if err := start_unreachable(c.graph); err != nil {
+		return err;
+	}
+	graph := within_output_depth(c.graph, c.max_output_depth);
+	slog.Info("Writing output", "path", c.output_path, "pages", len(graph.reports), "nodes", len(graph.nodes), "edges", len(graph.edges));
+	return c.write(c.output_path, graph);
+}
+
+/* The error for a crawl whose start pages could all not be fetched, so there is nothing to write */
+var err_start_unreachable = errors.New("cannot reach the start page");
+
+/*
+Returns an error describing why the start pages could not be fetched, if none of them could.
+A start page which answered, even with an error status, or which has no links still makes a normal, if small, crawl.
+*/
+func start_unreachable(graph *Graph) error {
+	var failed *crawler.PageReport;
+	for _, r := range graph.reports {
+		if (r.Depth != 0) {
+			continue;
+		}
+		if (!r.FetchError) {
+			return nil;
+		}
+		failed = r;
+	}
+	if (failed == nil) {
+		return nil;
+	}
+	return fmt.Errorf("%w %s: %s", err_start_unreachable, failed.URL, failed.Err);
+}
+
+/* A failed checkpoint is logged but does not stop the crawl */
+func (c *GraphConsumer) save_checkpoint() {
+	c.last_checkpoint = time.Now();
+	if err := save_checkpoint(c.checkpoint, c.graph); err != nil {
+		slog.Error("Error saving checkpoint", "err", err);
+	}
+}
+
+type ndjson_link struct {
+	From string `json:"from"`;
+	To string `json:"to"`;
+	URL string `json:"url"`;
+	Href string `json:"href,omitempty"`;
+	Text string `json:"text,omitempty"`;
+	Kind string `json:"kind"`;
+	External bool `json:"external,omitempty"`;
+}
+
+type ndjson_page struct {
+	Page string `json:"page"`;
+	URL string `json:"url"`;
+	Status int `json:"status"`; // 0 if no response was received
+	Error string `json:"error,omitempty"`;
+	Title string `json:"title,omitempty"`;
+	Canonical string `json:"canonical,omitempty"`;
+	Depth int `json:"depth"`;
+	Broken bool `json:"broken"`;
+}
+
+/*
+NDJSONConsumer writes each result as one JSON object per line as soon as it arrives, for -format ndjson,
+so the output can be read while the crawl runs and no graph is held in memory.
+A link is written every time it is found, and the status of its target is on the target's own page line,
+which comes later as links are found before the pages they point to are fetched.
+*/
+type NDJSONConsumer struct {
+	f output_file;
+	enc *json.Encoder;
+	err error; // the first write error, after which nothing more is written
+	stats *crawler.CrawlStats;
+	pages int; // page lines written, one for every page scraped
+	links int64;
+	broken int;
+	start_failed *crawler.PageReport; // a start page that could not be fetched, nil once one could
+	start_ok bool;
+}
+
+func new_ndjson_consumer(output_path string, stats *crawler.CrawlStats) (*NDJSONConsumer, error) {
+	f, err := create_output(output_path);
+	if err != nil {
+		return nil, err;
+	}
+	/* unlike the other formats the output is written as the results arrive, so this is logged before the crawl */
+	slog.Info("Writing output", "path", f.Name());
+	return &NDJSONConsumer{f: f, enc: json.NewEncoder(f), stats: stats}, nil;
+}
+
+func (c *NDJSONConsumer) Consume(val crawler.PageLink) {
+	var line any;
+	if (val.Report != nil) {
+		r := val.Report;
+		c.pages += 1;
+		if (crawler.IsBroken(r)) {
+			c.broken += 1;
+		}
+		if (r.Depth == 0) {
+			if (r.FetchError && !c.start_ok) {
+				c.start_failed = r;
+			} else if (!r.FetchError) {
+				c.start_ok, c.start_failed = true, nil;
+			}
+		}
+		line = ndjson_page{Page: string(r.Page), URL: r.URL, Status: r.Code, Error: r.Err, Title: r.Title, Canonical: r.CanonicalURL, Depth: r.Depth, Broken: crawler.IsBroken(r)};
+	} else {
+		c.links += 1;
+		c.stats.Edges.Store(c.links);
+		line = ndjson_link{From: string(val.From), To: string(val.To), URL: val.URL, Href: val.Href, Text: val.Text, Kind: val.Kind, External: val.External};
+	}
+	if (c.err == nil) {
+		c.err = c.enc.Encode(line);
+	}
+}
+
+func (c *NDJSONConsumer) Finish() error {
+	defer c.f.Close();
+	if (c.err != nil) {
+		return c.err;
+	}
+	if err := c.f.Sync(); err != nil {
+		return err;
+	}
+	slog.Info("Wrote output", "path", c.f.Name(), "pages", c.pages, "links", c.links);
+	if (c.start_failed != nil) {
+		return fmt.Errorf("%w %s: %s", err_start_unreachable, c.start_failed.URL, c.start_failed.Err);
+	}
+	return nil;
+}
+
+/* output_file is a file the results are written to, or stdout, which is neither synced nor closed */
+type output_file struct {
+	*os.File;
+}
+
+func (f output_file) Sync() error {
+	if (f.File == os.Stdout) {
+		return nil;
+	}
+	return f.File.Sync();
+}
+
+func (f output_file) Close() error {
+	if (f.File == os.Stdout) {
+		return nil;
+	}
+	return f.File.Close();
+}
+
+/* Creates the output file, and its directory if needed. The path - means stdout */
+func create_output(output_path string) (output_file, error) {
+	if (output_path == "-") {
+		return output_file{os.Stdout}, nil;
+	}
+	if err := os.MkdirAll(filepath.Dir(output_path), 0755); err != nil {
+		return output_file{}, fmt.Errorf("cannot create directory for %s: %v", output_path, err);
+	}
+	f, err := os.Create(output_path);
+	if err != nil {
+		return output_file{}, fmt.Errorf("cannot create %s: %v", output_path, err);
+	}
+	return output_file{f}, nil;
+}
+
+/* Labels an edge with its link text where it has one, followed by how many times it was linked if more than once */
+func edge_label(e PageLinkEdge) string {
+	if (e.text == "") {
+		return strconv.Itoa(e.count);
+	}
+	if (e.count > 1) {
+		return e.text + " (" + strconv.Itoa(e.count) + ")";
+	}
+	return e.text;
+}
+
+/* Node text colours by depth, the start page black and then cycling through colours that stay readable on white */
+var depth_colors = []string{"#000000", "#1f77b4", "#d62728", "#2ca02c", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"};
+
+/* Edge colours by kind, links between pages black; kinds without a colour, such as those from older checkpoints, are black too */
+var kind_colors = map[string]string{
+	"image": "#2ca02c",
+	"script": "#d62728",
+	"stylesheet": "#1f77b4",
+	"asset": "#17becf",
+	"link": "#7f7f7f",
+	"frame": "#9467bd",
+	"media": "#8c564b",
+	"redirect": "#ff7f0e",
+};
+
+/* Returns the colour to draw an edge in */
+func edge_color(e PageLinkEdge) string {
+	if color, ok := kind_colors[e.kind]; ok {
+		return color;
+	}
+	return "#000000";
+}
+
+/* Pages with more links are drawn larger, from 12px for a page without links up to 36px */
+func node_font_size(out_degree int) int {
+	size := 12 + out_degree;
+	if (size > 36) {
+		size = 36;
+	}
+	return size;
+}
+
+/*
+Quotes a string as a JavaScript string literal for an inline <script>.
+JSON strings are valid JavaScript, and encoding/json escapes <, > and & so a url containing </script> cannot end the script.
+*/
+func js_string(value string) string {
+	quoted, _ := json.Marshal(value);
+	return string(quoted);
+}
+
+//go:embed springy.js
+var springy_js []byte;
+
+//go:embed springyui.js
+var springyui_js []byte;
+
+//go:embed jquery.min.js
+var jquery_js []byte;
+
+/*
+Where jQuery and the SpringyJS scripts are loaded from, by -springy-source, in the order they are loaded.
+The cdn has no springyui.js but the upstream one, whose labels overlap when nodes have different font sizes,
+so with "cdn" our springyui.js is written into the html instead.
+*/
+var springy_scripts = map[string][]string{
+	"local": {"jquery.min.js", "springy.js", "springyui.js"}, // written next to the output file
+	"cdn": {"https://ajax.googleapis.com/ajax/libs/jquery/3.6.1/jquery.min.js", "https://cdnjs.cloudflare.com/ajax/libs/springy/2.7.1/springy.min.js"},
+};
+
+/*
+Returns the writer of an html file which draws the graph using SpringyJS.
+With source "local" the bundled copies of jQuery, springy.js and springyui.js are written next to it, so it renders offline,
+and with "cdn" only springyui.js is bundled, inside the html.
+*/
+func springyjs_writer(source string) graph_writer {
+	return func(output_path string, graph *Graph) error {
+		if (source == "local") {
+			dir := filepath.Dir(output_path);
+			if err := write_file(filepath.Join(dir, "jquery.min.js"), jquery_js); err != nil {
+				return err;
+			}
+			if err := write_file(filepath.Join(dir, "springy.js"), springy_js); err != nil {
+				return err;
+			}
+			if err := write_file(filepath.Join(dir, "springyui.js"), springyui_js); err != nil {
+				return err;
+			}
+			return write_springyjs(output_path, graph, springy_scripts[source], nil);
+		}
+		return write_springyjs(output_path, graph, springy_scripts[source], springyui_js);
+	};
+}
+
+/* Creates output_path holding data */
+func write_file(output_path string, data []byte) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+	if _, err := f.Write(data); err != nil {
+		return err;
+	}
+	return f.Sync();
+}
+
+/* Writes an html file which draws the graph using SpringyJS, loading jQuery and its scripts from the given urls, then running inline if it is not nil */
+func write_springyjs(output_path string, graph *Graph, scripts []string, inline []byte) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	f.WriteString("<html>\n<body>\n");
+	for _, src := range scripts {
+		f.WriteString("<script src=\"" + src + "\"></script>\n");
+	}
+	if (inline != nil) {
+		f.WriteString("<script>\n");
+		f.Write(inline);
+		f.WriteString("\n</script>\n");
+	}
+	f.WriteString("<script>\nvar graph = new Springy.Graph();\n");
+
+	degrees := out_degrees(graph);
+	for _, n := range graph.nodes {
+		f.WriteString("graph.addNodes(" + js_string(n) + ");\n");
+		if title, ok := graph.titles[n]; ok {
+			f.WriteString("graph.nodeSet[" + js_string(n) + "].data.label = " + js_string(title) + ";\n");
+		}
+		f.WriteString("graph.nodeSet[" + js_string(n) + "].data.font = '" + strconv.Itoa(node_font_size(degrees[n])) + "px Verdana, sans-serif';\n");
+		if d, ok := graph.depths[n]; ok {
+			f.WriteString("graph.nodeSet[" + js_string(n) + "].data.color = '" + depth_colors[d % len(depth_colors)] + "';\n");
+		}
 	}
 
 	f.WriteString("graph.addEdges(\n");
 
-	for _, e := range edges {
-		f.WriteString("['" + string(e.from) + "', '" + string(e.to) + "'," +
-			"{color: '#000000', label: '" + strconv.Itoa(e.count) + "'}" + 
+	for _, e := range graph.edges {
+		f.WriteString("[" + js_string(e.from) + ", " + js_string(e.to) + "," +
+			"{color: '" + edge_color(e) + "', label: " + js_string(edge_label(e)) + "}" +
 			"],\n");
 	}
 
@@ -269,12 +1206,638 @@ func springyjs_printer(input chan PageLink) {
 
 	f.WriteString("jQuery(function(){\nvar springy = jQuery('#springydemo').springy({\ngraph: graph\n});\n});\n</script>\n<canvas id=\"springydemo\" width=\"1200\" height=\"800\" />\n</body>\n</html>");
 
-	f.Sync();
-	f.Close();
-	os.Exit(0);
+	return f.Sync();
+}
+
+type json_edge struct {
+	From string `json:"from"`;
+	To string `json:"to"`;
+	URL string `json:"url,omitempty"`; // only saved in checkpoints
+	Text string `json:"text,omitempty"`;
+	Kind string `json:"kind,omitempty"`;
+	Count int `json:"count"`;
+}
+
+type json_graph struct {
+	Nodes []string `json:"nodes"`;
+	OutDegrees map[string]int `json:"out_degrees"`;
+	Depths map[string]int `json:"depths"`;
+	Edges []json_edge `json:"edges"`;
+}
+
+/* Writes the graph as a JSON object with nodes and edges arrays, and each node's out-degree and depth */
+func write_json(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	out := json_graph{Nodes: graph.nodes, OutDegrees: make(map[string]int), Depths: make(map[string]int), Edges: []json_edge{}};
+	degrees := out_degrees(graph);
+	for _, n := range graph.nodes {
+		out.OutDegrees[n] = degrees[n];
+		if d, ok := graph.depths[n]; ok {
+			out.Depths[n] = d;
+		}
+	}
+	for _, e := range graph.edges {
+		out.Edges = append(out.Edges, json_edge{From: e.from, To: e.to, Text: e.text, Kind: e.kind, Count: e.count});
+	}
+
+	enc := json.NewEncoder(f);
+	enc.SetIndent("", "  ");
+	if err := enc.Encode(out); err != nil {
+		return err;
+	}
+	return f.Sync();
+}
+
+/* Quotes a string as a DOT ID, escaping backslashes, quotes and line breaks */
+func dot_quote(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "");
+	return "\"" + replacer.Replace(value) + "\"";
+}
+
+/* Writes the graph as a Graphviz digraph, labelling each edge with its count and colouring it by kind */
+func write_dot(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	f.WriteString("digraph crawl {\n");
+	for _, n := range graph.nodes {
+		f.WriteString("\t" + dot_quote(n) + ";\n");
+	}
+	for _, e := range graph.edges {
+		f.WriteString("\t" + dot_quote(e.from) + " -> " + dot_quote(e.to) +
+			" [label=\"" + strconv.Itoa(e.count) + "\", color=\"" + edge_color(e) + "\"];\n");
+	}
+	f.WriteString("}\n");
+
+	return f.Sync();
 }
 
+/* Writes one from,to,count,from_out_degree,text,kind row per edge, after a header row */
+func write_csv(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	w := csv.NewWriter(f);
+	degrees := out_degrees(graph);
+	w.Write([]string{"from", "to", "count", "from_out_degree", "text", "kind"});
+	for _, e := range graph.edges {
+		w.Write([]string{e.from, e.to, strconv.Itoa(e.count), strconv.Itoa(degrees[e.from]), e.text, e.kind});
+	}
+	w.Flush();
+	if err := w.Error(); err != nil {
+		return err;
+	}
+	return f.Sync();
+}
+
+/* Writes a block per page with links, listing each page it links to with the count, e.g. "/a.html:" then "  -> /b.html (2)" */
+func write_adjacency(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	targets := make(map[string][]PageLinkEdge);
+	for _, e := range graph.edges {
+		targets[e.from] = append(targets[e.from], e);
+	}
+	for _, n := range graph.nodes {
+		if (len(targets[n]) == 0) {
+			continue;
+		}
+		f.WriteString(n + ":\n");
+		for _, e := range targets[n] {
+			f.WriteString("  -> " + e.to + " (" + strconv.Itoa(e.count) + ")\n");
+		}
+	}
+	return f.Sync();
+}
+
+/* Prints each start page of -dry-run with the urls on it and their verdicts, reporting whether every start page was scraped */
+func print_dry_run(pages []crawler.DryRunPage) bool {
+	ok := true;
+	for _, page := range pages {
+		fmt.Println(page.URL + "\t" + page.Status);
+		for _, hop := range page.Redirects {
+			fmt.Println("\tredirected to " + hop);
+		}
+		for _, link := range page.Links {
+			fmt.Println("\t" + link.URL + "\t" + link.Verdict);
+		}
+		if (page.Status != "Done") {
+			ok = false;
+		}
+	}
+	return ok;
+}
+
+/*
+Prints every page linking to target to w, with the text of its link where it has any.
+A path such as /old.html, old.html or ../old.html matches the links to that page on the target, however they were
+written, and a full url those to the same page on its host, e.g. http://host/old.html also matches http://HOST:80/old.html.
+*/
+func print_backlinks(w io.Writer, graph *Graph, target string) {
+	if i := strings.Index(target, "#"); i >= 0 {
+		target = target[:i];
+	}
+	tu, err := url.Parse(target);
+	if (err != nil) {
+		fmt.Fprintln(w, target + " is not a valid url or path");
+		return;
+	}
+	absolute := tu.Scheme != "" && tu.Host != "";
+	if (!absolute) {
+		/* nodes on the target are named by their path from the root, see crawler.PageLink.To */
+		root := &url.URL{Path: "/"};
+		target = root.ResolveReference(tu).RequestURI();
+	}
+	sources := []PageLinkEdge{};
+	for _, e := range graph.edges {
+		if ((absolute && same_page(e.url, tu)) || (!absolute && e.to == target)) {
+			sources = append(sources, e);
+		}
+	}
+	fmt.Fprintln(w, target + " is linked from " + strconv.Itoa(len(sources)) + " pages");
+	for _, e := range sources {
+		line := "\t" + e.from;
+		if (e.text != "") {
+			line += "\t" + strconv.Quote(e.text);
+		}
+		fmt.Fprintln(w, line);
+	}
+}
+
+/* Reports whether raw is the url of the page target is, on the same host with the same path and query */
+func same_page(raw string, target *url.URL) bool {
+	u, err := url.Parse(raw);
+	return err == nil && crawler.CanonicalHost(u) == crawler.CanonicalHost(target) && u.RequestURI() == target.RequestURI();
+}
+
+/* Returns how many of the graph's pages are broken */
+func count_broken(graph *Graph) int {
+	n := 0;
+	for _, r := range graph.reports {
+		if (crawler.IsBroken(r)) {
+			n += 1;
+		}
+	}
+	return n;
+}
 
+/* Writes every broken url with its status and the pages linking to it */
+func write_brokenlinks(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
 
+	broken := []*crawler.PageReport{};
+	linked_from := make(map[string][]string);
+	for _, r := range graph.reports {
+		if (crawler.IsBroken(r)) {
+			broken = append(broken, r);
+			linked_from[r.URL] = []string{};
+		}
+	}
+	for _, e := range graph.edges {
+		if sources, ok := linked_from[e.url]; ok && !contains(e.from, sources) {
+			linked_from[e.url] = append(sources, e.from);
+		}
+	}
 
+	for _, r := range broken {
+		f.WriteString(r.URL + " : " + r.Status + "\n");
+		for _, from := range linked_from[r.URL] {
+			f.WriteString("\tlinked from " + from + "\n");
+		}
+	}
+	f.WriteString(strconv.Itoa(len(broken)) + " broken links found\n");
 
+	return f.Sync();
+}
+
+/* Returns the url the page was finally fetched from, after any redirects */
+func landed_url(report *crawler.PageReport) string {
+	if (len(report.Redirects) > 0) {
+		return report.Redirects[len(report.Redirects) - 1];
+	}
+	return report.URL;
+}
+
+/* Writes each group of urls that served the same html body, e.g. the same page under several urls */
+func write_duplicates(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	hashes := []string{}; // in the order first seen
+	urls := make(map[string][]string);
+	for _, r := range graph.reports {
+		if (r.Hash == "") {
+			continue;
+		}
+		if _, ok := urls[r.Hash]; !ok {
+			hashes = append(hashes, r.Hash);
+		}
+		if u := landed_url(r); !contains(u, urls[r.Hash]) {
+			urls[r.Hash] = append(urls[r.Hash], u);
+		}
+	}
+
+	clusters := 0;
+	for _, h := range hashes {
+		if (len(urls[h]) < 2) {
+			continue;
+		}
+		f.WriteString("sha256 " + h + "\n");
+		for _, u := range urls[h] {
+			f.WriteString("\t" + u + "\n");
+		}
+		clusters += 1;
+	}
+	f.WriteString(strconv.Itoa(clusters) + " groups of duplicate pages found\n");
+
+	return f.Sync();
+}
+
+type graphml_key struct {
+	ID string `xml:"id,attr"`;
+	For string `xml:"for,attr"`;
+	Name string `xml:"attr.name,attr"`;
+	Type string `xml:"attr.type,attr"`;
+}
+
+type graphml_data struct {
+	Key string `xml:"key,attr"`;
+	Value string `xml:",chardata"`;
+}
+
+type graphml_node struct {
+	ID string `xml:"id,attr"`;
+	Data []graphml_data `xml:"data"`;
+}
+
+type graphml_edge struct {
+	Source string `xml:"source,attr"`;
+	Target string `xml:"target,attr"`;
+	Data []graphml_data `xml:"data"`;
+}
+
+type graphml_document struct {
+	XMLName xml.Name `xml:"http://graphml.graphdrawing.org/xmlns graphml"`;
+	XSI string `xml:"xmlns:xsi,attr"`;
+	SchemaLocation string `xml:"xsi:schemaLocation,attr"`;
+	Keys []graphml_key `xml:"key"`;
+	Graph struct {
+		ID string `xml:"id,attr"`;
+		EdgeDefault string `xml:"edgedefault,attr"`;
+		Nodes []graphml_node `xml:"node"`;
+		Edges []graphml_edge `xml:"edge"`;
+	} `xml:"graph"`;
+}
+
+/*
+Writes the graph as a GraphML document for tools such as Gephi, with nodes named by their page and directed edges.
+Nodes carry their title as label, depth and out-degree; edges their count, kind and link text.
+*/
+func write_graphml(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	out := graphml_document{XSI: "http://www.w3.org/2001/XMLSchema-instance", SchemaLocation: "http://graphml.graphdrawing.org/xmlns http://graphml.graphdrawing.org/xmlns/1.0/graphml.xsd"};
+	out.Keys = []graphml_key{
+		{ID: "label", For: "node", Name: "label", Type: "string"},
+		{ID: "depth", For: "node", Name: "depth", Type: "int"},
+		{ID: "out_degree", For: "node", Name: "out_degree", Type: "int"},
+		{ID: "count", For: "edge", Name: "count", Type: "int"},
+		{ID: "kind", For: "edge", Name: "kind", Type: "string"},
+		{ID: "text", For: "edge", Name: "text", Type: "string"},
+	};
+	out.Graph.ID = "crawl";
+	out.Graph.EdgeDefault = "directed";
+	degrees := out_degrees(graph);
+	for _, n := range graph.nodes {
+		node := graphml_node{ID: n};
+		if title, ok := graph.titles[n]; ok {
+			node.Data = append(node.Data, graphml_data{Key: "label", Value: title});
+		}
+		if d, ok := graph.depths[n]; ok {
+			node.Data = append(node.Data, graphml_data{Key: "depth", Value: strconv.Itoa(d)});
+		}
+		node.Data = append(node.Data, graphml_data{Key: "out_degree", Value: strconv.Itoa(degrees[n])});
+		out.Graph.Nodes = append(out.Graph.Nodes, node);
+	}
+	for _, e := range graph.edges {
+		edge := graphml_edge{Source: e.from, Target: e.to, Data: []graphml_data{{Key: "count", Value: strconv.Itoa(e.count)}}};
+		if (e.kind != "") {
+			edge.Data = append(edge.Data, graphml_data{Key: "kind", Value: e.kind});
+		}
+		if (e.text != "") {
+			edge.Data = append(edge.Data, graphml_data{Key: "text", Value: e.text});
+		}
+		out.Graph.Edges = append(out.Graph.Edges, edge);
+	}
+
+	f.WriteString(xml.Header);
+	enc := xml.NewEncoder(f);
+	enc.Indent("", "  ");
+	if err := enc.Encode(out); err != nil {
+		return err;
+	}
+	f.WriteString("\n");
+	return f.Sync();
+}
+
+type xml_url struct {
+	Loc string `xml:"loc"`;
+	LastMod string `xml:"lastmod,omitempty"`;
+}
+
+type xml_urlset struct {
+	XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`;
+	URLs []xml_url `xml:"url"`;
+}
+
+/*
+Writes a sitemap.xml listing every html page that was crawled successfully, by the url it was served from.
+Pages marked noindex are left out, which is only checked with -obey-meta-robots, and with -use-canonical pages are listed by their canonical url.
+Only pages on the allowed hosts are ever fetched, so external links and assets are left out.
+*/
+func write_sitemap(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	out := xml_urlset{URLs: []xml_url{}};
+	seen := make(map[string]bool);
+	for _, r := range graph.reports {
+		if (((r.Code < 200 || r.Code > 299) && !r.NotModified) || !crawler.IsHTML(r.ContentType) || r.NoIndex || r.Soft404) {
+			continue;
+		}
+		loc := landed_url(r);
+		if (r.CanonicalURL != "") {
+			loc = r.CanonicalURL;
+		}
+		if (seen[loc]) {
+			continue;
+		}
+		seen[loc] = true;
+		entry := xml_url{Loc: loc};
+		if (!r.LastModified.IsZero()) {
+			entry.LastMod = r.LastModified.UTC().Format("2006-01-02");
+		}
+		out.URLs = append(out.URLs, entry);
+	}
+
+	f.WriteString(xml.Header);
+	enc := xml.NewEncoder(f);
+	enc.Indent("", "  ");
+	if err := enc.Encode(out); err != nil {
+		return err;
+	}
+	f.WriteString("\n");
+	return f.Sync();
+}
+
+/* Writes the fetched pages sorted slowest first, then sorted largest first */
+func write_timings(output_path string, graph *Graph) error {
+	f, err := create_output(output_path);
+	if err != nil {
+		return err;
+	}
+	defer f.Close();
+
+	fetched := []*crawler.PageReport{};
+	for _, r := range graph.reports {
+		if (r.Code != 0) {
+			fetched = append(fetched, r);
+		}
+	}
+	line := func(r *crawler.PageReport) string {
+		return fmt.Sprintf("%10.1f ms %12d bytes  %s\n", float64(r.Duration.Microseconds()) / 1000, r.Bytes, r.URL);
+	};
+
+	f.WriteString("Slowest pages\n");
+	sort.SliceStable(fetched, func(i, j int) bool { return fetched[i].Duration > fetched[j].Duration });
+	for _, r := range fetched {
+		f.WriteString(line(r));
+	}
+
+	f.WriteString("\nLargest pages\n");
+	sort.SliceStable(fetched, func(i, j int) bool { return fetched[i].Bytes > fetched[j].Bytes });
+	for _, r := range fetched {
+		f.WriteString(line(r));
+	}
+
+	return f.Sync();
+}
+
+
+/*
+
+==================================
+
+Checkpoints
+
+The pages visited and still pending and the graph found so far are saved as JSON,
+so that an interrupted crawl can be continued with -resume.
+The fetch reports are not saved, so reports such as brokenlinks only cover the pages fetched since resuming.
+
+*/
+
+/* checkpoint_version is increased whenever the checkpoint format changes */
+const checkpoint_version = 1;
+
+/* Checkpointer saves the crawl state and graph to path */
+type Checkpointer struct {
+	path string; // no checkpoints when empty
+	interval time.Duration; // between periodic checkpoints, 0 = only when the crawl ends
+	target string; // a checkpoint can only be resumed with the same -target
+	state *crawler.CrawlState;
+}
+
+type json_task struct {
+	Key string `json:"key"`; // normalized url, as in visited
+	Page string `json:"page"`;
+	URL string `json:"url"`;
+	Depth int `json:"depth"`;
+	Head bool `json:"head,omitempty"`;
+	External bool `json:"external,omitempty"`;
+	Document bool `json:"document,omitempty"`;
+}
+
+type json_checkpoint struct {
+	Version int `json:"version"`;
+	Target string `json:"target"`;
+	Visited []string `json:"visited"`;
+	Pending []json_task `json:"pending"`;
+	Nodes []string `json:"nodes"`;
+	Edges []json_edge `json:"edges"`;
+	Titles map[string]string `json:"titles"`;
+	Depths map[string]int `json:"depths,omitempty"`;
+	Pages map[string]json_page `json:"pages,omitempty"`; // by url, for -incremental
+}
+
+/* What -incremental needs to know about a page to ask whether it changed, and to reuse it if not */
+type json_page struct {
+	Page string `json:"page"`;
+	LastModified string `json:"last_modified,omitempty"`; // as in the Last-Modified header
+	ETag string `json:"etag,omitempty"`;
+	ContentType string `json:"content_type,omitempty"`;
+	Hash string `json:"hash,omitempty"`;
+}
+
+/* Writes the checkpoint to a temporary file which then replaces path, so an interruption never leaves a partial checkpoint */
+func save_checkpoint(checkpoint *Checkpointer, graph *Graph) error {
+	visited, pending := checkpoint.state.Snapshot();
+	out := json_checkpoint{Version: checkpoint_version, Target: checkpoint.target, Visited: visited, Pending: []json_task{}, Nodes: graph.nodes, Edges: []json_edge{}, Titles: graph.titles, Depths: graph.depths, Pages: checkpoint_pages(graph)};
+	for key, t := range pending {
+		out.Pending = append(out.Pending, json_task{Key: key, Page: string(t.Page), URL: t.URL, Depth: t.Depth, Head: t.Head, External: t.External, Document: t.Document});
+	}
+	sort.Strings(out.Visited);
+	sort.Slice(out.Pending, func(i, j int) bool { return out.Pending[i].Key < out.Pending[j].Key });
+	for _, e := range graph.edges {
+		out.Edges = append(out.Edges, json_edge{From: e.from, To: e.to, URL: e.url, Text: e.text, Kind: e.kind, Count: e.count});
+	}
+
+	tmp_path := checkpoint.path + ".tmp";
+	f, err := create_output(tmp_path);
+	if err != nil {
+		return err;
+	}
+	if err := json.NewEncoder(f).Encode(out); err != nil {
+		f.Close();
+		return err;
+	}
+	if err := f.Sync(); err != nil {
+		f.Close();
+		return err;
+	}
+	if err := f.Close(); err != nil {
+		return err;
+	}
+	return os.Rename(tmp_path, checkpoint.path);
+}
+
+/*
+Returns the pages to save for -incremental: those loaded from the checkpoint, updated with every page
+fetched since that has a Last-Modified or ETag header. Pages reached through a redirect are left out.
+*/
+func checkpoint_pages(graph *Graph) map[string]json_page {
+	pages := make(map[string]json_page);
+	for u, p := range graph.pages {
+		pages[u] = p;
+	}
+	for _, r := range graph.reports {
+		if ((r.Code < 200 || r.Code > 299) && !r.NotModified) {
+			continue;
+		}
+		if (r.External || len(r.Redirects) > 0 || (r.ETag == "" && r.LastModified.IsZero())) {
+			continue;
+		}
+		p := json_page{Page: string(r.Page), ETag: r.ETag, ContentType: r.ContentType, Hash: r.Hash};
+		if (!r.LastModified.IsZero()) {
+			p.LastModified = r.LastModified.UTC().Format(http.TimeFormat);
+		}
+		pages[r.URL] = p;
+	}
+	return pages;
+}
+
+/* Reads the checkpoint at checkpoint.path, checking it was saved for the same -target */
+func read_checkpoint(checkpoint *Checkpointer) (*json_checkpoint, error) {
+	f, err := os.Open(checkpoint.path);
+	if err != nil {
+		return nil, err;
+	}
+	defer f.Close();
+
+	var in json_checkpoint;
+	if err := json.NewDecoder(f).Decode(&in); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", checkpoint.path, err);
+	}
+	if (in.Version < 1 || in.Version > checkpoint_version) {
+		return nil, fmt.Errorf("%s has unsupported checkpoint version %d", checkpoint.path, in.Version);
+	}
+	if (in.Target != checkpoint.target) {
+		return nil, fmt.Errorf("%s was saved for -target %s", checkpoint.path, in.Target);
+	}
+	return &in, nil;
+}
+
+/*
+Returns the pages of the crawl saved at checkpoint.path for -incremental, each with the links that were found on it
+so they can be sent again if it has not changed.
+*/
+func load_previous(checkpoint *Checkpointer) (map[string]crawler.PreviousPage, error) {
+	in, err := read_checkpoint(checkpoint);
+	if err != nil {
+		return nil, err;
+	}
+	links := make(map[string][]crawler.PageLink);
+	for _, e := range in.Edges {
+		for i := 0; i < e.Count; i++ {
+			links[e.From] = append(links[e.From], crawler.PageLink{From: crawler.Resource(e.From), To: crawler.Resource(e.To), URL: e.URL, Text: e.Text, Kind: e.Kind});
+		}
+	}
+	previous := make(map[string]crawler.PreviousPage);
+	for u, p := range in.Pages {
+		prev := crawler.PreviousPage{ETag: p.ETag, Title: in.Titles[p.Page], ContentType: p.ContentType, Hash: p.Hash, Links: links[p.Page]};
+		if modified, err := http.ParseTime(p.LastModified); err == nil {
+			prev.LastModified = modified;
+		}
+		previous[u] = prev;
+	}
+	return previous, nil;
+}
+
+/* Loads the checkpoint at checkpoint.path into its state and graph */
+func load_checkpoint(checkpoint *Checkpointer, graph *Graph) error {
+	in, err := read_checkpoint(checkpoint);
+	if err != nil {
+		return err;
+	}
+
+	pending := make(map[string]crawler.ScrapeTask);
+	for _, t := range in.Pending {
+		pending[t.Key] = crawler.ScrapeTask{Page: crawler.Resource(t.Page), URL: t.URL, Depth: t.Depth, Head: t.Head, External: t.External, Document: t.Document};
+	}
+	checkpoint.state.Restore(in.Visited, pending);
+	for _, node := range in.Nodes {
+		insertNode(node, graph);
+	}
+	for _, e := range in.Edges {
+		graph.edge_index[edge_key{from: e.From, to: e.To}] = len(graph.edges);
+		graph.edges = append(graph.edges, PageLinkEdge{from: e.From, to: e.To, url: e.URL, text: e.Text, kind: e.Kind, count: e.Count});
+	}
+	for node, title := range in.Titles {
+		graph.titles[node] = title;
+	}
+	for node, depth := range in.Depths {
+		graph.depths[node] = depth;
+	}
+	for u, p := range in.Pages {
+		graph.pages[u] = p;
+	}
+	return nil;
+}
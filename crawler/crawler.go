@@ -0,0 +1,2727 @@
+/*
+Package crawler crawls a website and streams the links it finds.
+
+Crawl starts the workers and returns the channel they send their results on, which is closed
+once every page within the configured limits has been scraped or the context is cancelled.
+Each crawl has its own HTTP client, cookie jar, rate limiter, robots.txt cache and set of visited
+pages, and the package keeps no mutable state of its own, so several crawls may run at once as long
+as they do not share a Config's Stats or State.
+The kieranvs/web-crawler command is a thin wrapper which parses flags into a Config and writes
+the results as a graph.
+*/
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net"
+	"net/url"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/publicsuffix"
+)
+
+/* Resource represents a page or file */
+type Resource string;
+
+/*
+PageLink represents a link from one Resource to another.
+Workers also send a PageLink carrying only a report once they have scraped a page.
+*/
+type PageLink struct {
+	From Resource;
+	To Resource;
+	URL string; // absolute url of To
+	Href string; // the link as written in the page, for display, empty for a redirect
+	Text string; // visible text of an <a> link, or alt text of an image inside it or of an <area>
+	Depth int; // link hops from the start page to To
+	External bool; // To is not on an allowed host
+	Kind string; // what the link is, from the tag it was found in: see link_kinds, or "redirect" for a redirect hop
+	Report *PageReport; // non-nil for fetch reports, which are not edges
+}
+
+/* PageReport records the outcome of scraping one page */
+type PageReport struct {
+	Page Resource;
+	Depth int; // of the task, link hops from the start page
+	Final Resource; // page whose links were collected, differs from Page after a redirect
+	Title string; // contents of <title>, empty if the page has none
+	URL string;
+	Status string; // as printed by the worker
+	Code int; // HTTP status code, 0 if no response was received
+	FetchError bool; // the request failed without a response
+	Err string; // why the request failed when FetchError is set, e.g. "connection refused"
+	Redirects []string; // urls the request was redirected through, in order
+	Duration time.Duration; // from sending the request until the body was read
+	Bytes int64; // body bytes read, as sent on the wire
+	Hash string; // hex SHA-256 of the decoded html body, empty unless it was read completely
+	ContentType string; // Content-Type header of a 2xx response
+	LastModified time.Time; // from the Last-Modified header of a 2xx response, zero if missing or invalid
+	NoIndex bool; // the page has <meta name="robots" content="noindex">, only checked with ObeyMetaRobots
+	External bool; // a link to another host that was only checked, with CheckExternal
+	ETag string; // ETag header of a 2xx response
+	NotModified bool; // the server answered 304 to a conditional request, the rest is from the PreviousPage
+	Soft404 bool; // answered 2xx, but looks like the host's not found page, only checked with DetectSoft404
+	Canonical Resource; // with UseCanonical, the page named by <link rel="canonical"> if it is not Final, links found after it belong to it
+	CanonicalURL string; // absolute url of Canonical
+}
+
+/* PreviousPage is what an earlier crawl found on a page, so that a re-crawl only downloads it again if it changed */
+type PreviousPage struct {
+	LastModified time.Time; // sent as If-Modified-Since unless zero
+	ETag string; // sent as If-None-Match unless empty
+	Title string;
+	ContentType string;
+	Hash string;
+	Links []PageLink; // found on the page, each as many times as it was linked; sent again, and followed, if it has not changed
+}
+
+/* ScrapeTask represents a link which needs to be followed by a worker */
+type ScrapeTask struct {
+	BaseURL string;
+	Page Resource;
+	URL string; // absolute url of Page, resolved where the link was found
+	Depth int;
+	Head bool; // an asset link checked with a HEAD request rather than fetched
+	External bool; // a link to another host, checked for its status but never scraped
+	Document bool; // a start page or the target of an <a>, <area> or <iframe>, asked for with the Accept setting
+}
+
+/* CrawlStats are progress counters updated by the buffer, the workers and the caller's consumer */
+type CrawlStats struct {
+	Crawled atomic.Int64; // pages scraped, whatever the outcome
+	Queued atomic.Int64; // tasks waiting for a worker
+	InFlight atomic.Int64; // tasks handed to a worker and not yet done
+	Edges atomic.Int64; // distinct edges found so far, left to whoever consumes the results
+}
+
+/* ScrapeOptions decide which of the discovered urls get scraped */
+type ScrapeOptions struct {
+	allowed_hosts []string; // lower case, without default ports as from canonical_host; always includes the target's host
+	include_subdomains bool;
+	record_external bool; // links to other hosts are recorded as edges but never queued
+	check_external bool; // links to other hosts are queued as External tasks, which are only checked
+	crawl_css bool; // fetch stylesheets and record the urls they reference
+	file_source bool; // file:/// urls are crawled, served from the base url's directory
+	scan_js bool; // record url-like string literals in scripts
+	normalize *NormalizeOptions; // query parameters to strip from links
+	include []*regexp.Regexp; // when set, only links matching one of these are queued
+	exclude []*regexp.Regexp; // links matching any of these are never queued
+	skip_extensions map[string]bool; // lower case without the dot, links to these are recorded but never fetched
+	head_assets bool; // links to skip_extensions files are checked with a HEAD request instead
+	scope_prefix string; // when set, only urls whose path starts with it are queued
+	omit_edges map[string]bool; // tags whose links are followed as usual but not recorded as edges
+	follow_iframes bool; // <iframe> sources are crawled like links
+	obey_nofollow bool; // <a rel="nofollow"> links are recorded but not queued
+	obey_meta_robots bool; // <meta name="robots"> nofollow stops a page's links being queued, noindex is reported
+	previous map[string]PreviousPage; // pages of an earlier crawl by url, fetched with conditional requests
+	max_redirects int; // redirects followed for one request before it fails with err_too_many_redirects
+	use_canonical bool; // a page's <link rel="canonical"> on an allowed host stands for it, and is not crawled again
+	mirror string; // directory html pages are saved in by host and path, none when empty
+}
+
+/* Fetcher holds the HTTP settings shared by all workers */
+type Fetcher struct {
+	client *http.Client;
+	user_agent string;
+	accept string; // Accept header of page requests, none when empty
+	header http.Header; // extra headers, only sent to allowed hosts like the credentials
+	robots *RobotsCache; // nil when robots.txt is ignored
+	soft_404 *Soft404Cache; // nil unless soft 404s are detected
+	limiter *HostLimiter;
+	connections *HostConnections;
+	retries int; // extra attempts after a connection error or 5xx response
+	username string; // basic auth, not sent when empty
+	password string;
+	options *ScrapeOptions; // credentials are only sent to its allowed hosts
+	max_bytes int64; // largest decoded body that is parsed, 0 = no limit
+}
+
+/*
+Config holds the settings of one crawl.
+Zero values mean no limit, except that Workers must be at least 1 and MaxDepth 0 only scrapes the start page.
+*/
+type Config struct {
+	BaseURL string; // e.g. http://website.com, or a directory when Source is "file"
+	StartPage string; // resolved against BaseURL, e.g. /index.html
+	Seeds []string; // urls to start at instead of StartPage, absolute or relative to BaseURL
+	Sitemap string; // url of a sitemap or sitemap index, absolute or relative to BaseURL, whose pages are the start pages instead
+	Source string; // "http" (the default), or "file" to crawl the html files in the BaseURL directory
+	Workers int; // concurrent requests
+	MaxDepth int; // link hops from the start page to crawl, -1 = unlimited
+	MaxPages int; // distinct pages queued before new ones are dropped
+	Order string; // "bfs" (the default) finishes each depth before the next, or "dfs"
+	IgnoreQuery bool; // urls that differ only in their query are the same page
+	IgnoreQueryParams []string; // query parameters dropped from links, e.g. utm_source
+	SortQuery bool; // urls whose query parameters differ only in order are the same page
+	Timeout time.Duration; // per request
+	UserAgent string;
+	Accept string; // Accept header sent when fetching a page, but not stylesheets, scripts, assets, external links or robots.txt
+	Header http.Header; // sent with every request to the allowed hosts, an Accept or Accept-Encoding in it overrides ours, and a Host sets the request's host
+	IgnoreRobots bool;
+	Delay time.Duration; // minimum between requests to the same host
+	DelayJitter time.Duration; // up to this much is added to each wait at random, so the spacing is less regular
+	PerHostConnections int; // requests in flight to the same host at once, however many Workers there are
+	Username string; // HTTP basic auth, sent only to allowed hosts
+	Password string;
+	Proxy string; // proxy url for all requests, by default from HTTP_PROXY/HTTPS_PROXY
+	NoCookies bool; // do not keep the cookies responses set and send them back on later requests
+	Cookies []*http.Cookie; // put in the cookie jar before the crawl starts, for their Domain or else the target's host
+	Insecure bool; // skip TLS certificate verification
+	MaxBytes int64; // largest page body that is parsed
+	Retries int; // times to retry after a connection error or 5xx response
+	AllowedHosts []string; // crawled besides the hosts of BaseURL and the seeds
+	IncludeSubdomains bool;
+	CheckExternal bool; // links to other hosts are checked with one HEAD request (GET if refused) each, but not crawled
+	RecordExternal bool; // links to other hosts are recorded but never queued
+	CrawlCSS bool; // fetch stylesheets and record the url() references inside them
+	ScanJS bool; // record url-like string literals found in scripts
+	Include []*regexp.Regexp; // when set, only links matching one of these are queued
+	Exclude []*regexp.Regexp; // links matching any of these are never queued
+	SkipExtensions []string; // links to files with these extensions are recorded but never fetched
+	HeadAssets bool; // links to SkipExtensions files are checked with a HEAD request instead, recording their status
+	MaxRequests int64; // HTTP requests sent in total, including redirects, retries and robots.txt, before the crawl winds down
+	MaxRedirects int; // redirects followed for one request before it fails with "Too many redirects", 0 = default_max_redirects
+	NoRedirects bool; // follow no redirects, so every one fails with "Too many redirects"
+	FollowIframes bool; // crawl the pages in <iframe>s, which are otherwise only recorded like <embed> and <object>
+	ObeyNofollow bool; // links with rel="nofollow" are recorded as edges but not crawled
+	ObeyMetaRobots bool; // obey <meta name="robots">: nofollow pages' links are recorded but not crawled, noindex sets PageReport.NoIndex
+	DetectSoft404 bool; // compare pages with what each host returns for a url that does not exist, setting PageReport.Soft404
+	UseCanonical bool; // a page's <link rel="canonical"> sets PageReport.Canonical, and the canonical url is not crawled separately
+	Mirror string; // directory every html page read completely is saved in, as <host>/<path>
+	NoLinkEdges bool; // links from <a> and <area> are crawled but not sent as PageLinks
+	NoImageEdges bool; // <img> sources are not sent as PageLinks
+	NoScriptEdges bool; // <script> sources and the urls found in scripts are not sent as PageLinks
+	NoStyleEdges bool; // <link> hrefs, such as stylesheets and icons, are not sent as PageLinks
+	ScopePrefix string; // when set, only urls whose path starts with it are queued, e.g. /docs/, or a url whose path is used
+	SubmitBuffer int; // capacity of the channel carrying discovered links to the queue
+	ResultsBuffer int; // capacity of the returned channel
+	Previous map[string]PreviousPage; // by url as requested, pages of an earlier crawl that are fetched with conditional requests
+	Stats *CrawlStats; // optional, updated as the crawl progresses
+	State *CrawlState; // optional, records the crawl for checkpoints, and is resumed from if not empty
+}
+
+/* Returns an error naming a setting of cfg that is out of range or unknown, or nil if every one is usable */
+func (cfg Config) Validate() error {
+	if (cfg.Workers < 1) {
+		return fmt.Errorf("workers must be at least 1, got %d", cfg.Workers);
+	}
+	if (cfg.MaxDepth < -1) {
+		return fmt.Errorf("max depth must be -1 (unlimited) or more, got %d", cfg.MaxDepth);
+	}
+	for name, value := range map[string]int64{"max pages": int64(cfg.MaxPages), "max requests": cfg.MaxRequests, "retries": int64(cfg.Retries), "max bytes": cfg.MaxBytes, "timeout": int64(cfg.Timeout), "delay": int64(cfg.Delay), "delay jitter": int64(cfg.DelayJitter), "per host connections": int64(cfg.PerHostConnections), "max redirects": int64(cfg.MaxRedirects)} {
+		if (value < 0) {
+			return fmt.Errorf("%s cannot be negative", name);
+		}
+	}
+	if (cfg.NoRedirects && cfg.MaxRedirects > 0) {
+		return errors.New("max redirects cannot be given when redirects are disabled");
+	}
+	if (cfg.NoCookies && len(cfg.Cookies) > 0) {
+		return errors.New("cookies cannot be given when cookies are disabled");
+	}
+	if (cfg.SubmitBuffer < 0 || cfg.ResultsBuffer < 0) {
+		return errors.New("channel buffers cannot be negative");
+	}
+	if (cfg.Sitemap != "" && len(cfg.Seeds) > 0) {
+		return errors.New("seeds and a sitemap cannot be used together");
+	}
+	if (cfg.Order != "" && cfg.Order != "bfs" && cfg.Order != "dfs") {
+		return fmt.Errorf("unknown crawl order: %s", cfg.Order);
+	}
+	switch (cfg.Source) {
+	case "", "http":
+		if _, err := resolve_base(cfg.BaseURL); err != nil {
+			return err;
+		}
+	case "file":
+		if info, err := os.Stat(strings.TrimPrefix(cfg.BaseURL, "file://")); err != nil || !info.IsDir() {
+			return fmt.Errorf("source file needs the base url to be a directory: %s", cfg.BaseURL);
+		}
+	default:
+		return fmt.Errorf("unknown source: %s", cfg.Source);
+	}
+	return nil;
+}
+
+/* crawl is what Crawl and DryRun set up from a Config */
+type crawl struct {
+	options *ScrapeOptions;
+	fetcher *Fetcher;
+	base string; // the resolved base url the tasks are named against, e.g. http://example.com for example.com
+	starts []ScrapeTask;
+}
+
+/*
+Validates cfg and builds the options, fetcher and start tasks shared by all workers.
+With a Sitemap it is fetched to find the start pages, until ctx is cancelled.
+*/
+func new_crawl(ctx context.Context, cfg Config) (*crawl, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err;
+	}
+	/* with source file, BaseURL names the directory served as file:/// */
+	target_base := cfg.BaseURL;
+	site_root := "";
+	if (cfg.Source == "file") {
+		site_root = strings.TrimPrefix(cfg.BaseURL, "file://");
+		target_base = "file:///";
+	} else if target_base, _ = resolve_base(cfg.BaseURL); target_base != cfg.BaseURL {
+		slog.Warn("The base url has no scheme, using " + target_base, "base", cfg.BaseURL);
+	}
+
+	start_url, err := fix_url(target_base, cfg.StartPage);
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url or start page: %v", err);
+	}
+	start_urls := []string{start_url};
+	if (len(cfg.Seeds) > 0 || cfg.Sitemap != "") {
+		start_urls = []string{};
+	}
+	for _, text := range cfg.Seeds {
+		seed, err := fix_url(target_base, text);
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed %s: %v", text, err);
+		}
+		if scheme := url_scheme(seed); scheme != "http" && scheme != "https" && scheme != url_scheme(target_base) {
+			return nil, fmt.Errorf("seed is not an http url: %s", text);
+		}
+		start_urls = append(start_urls, seed);
+	}
+
+	normalize := &NormalizeOptions{sort_query: cfg.SortQuery, ignore_query: cfg.IgnoreQuery, ignore_params: make(map[string]bool)};
+	for _, name := range cfg.IgnoreQueryParams {
+		if name = strings.TrimSpace(name); name != "" {
+			normalize.ignore_params[name] = true;
+		}
+	}
+
+	options := &ScrapeOptions{normalize: normalize, include_subdomains: cfg.IncludeSubdomains, record_external: cfg.RecordExternal, check_external: cfg.CheckExternal, crawl_css: cfg.CrawlCSS, scan_js: cfg.ScanJS, file_source: site_root != "", include: cfg.Include, exclude: cfg.Exclude, head_assets: cfg.HeadAssets, follow_iframes: cfg.FollowIframes, obey_nofollow: cfg.ObeyNofollow, obey_meta_robots: cfg.ObeyMetaRobots, previous: cfg.Previous, max_redirects: cfg.MaxRedirects, use_canonical: cfg.UseCanonical, mirror: cfg.Mirror};
+	if (cfg.NoRedirects) {
+		options.max_redirects = 0;
+	} else if (options.max_redirects == 0) {
+		options.max_redirects = default_max_redirects;
+	}
+	if bu, err := url.Parse(target_base); err == nil {
+		options.allowed_hosts = append(options.allowed_hosts, canonical_host(bu));
+	}
+	if (cfg.ScopePrefix != "") {
+		options.scope_prefix = cfg.ScopePrefix;
+		if su, err := url.Parse(cfg.ScopePrefix); err == nil && su.Scheme != "" {
+			options.scope_prefix = su.Path;
+		}
+		for _, seed := range start_urls {
+			if (!in_scope(options, seed)) {
+				return nil, fmt.Errorf("start page %s is outside the scope prefix %s", seed, options.scope_prefix);
+			}
+		}
+	}
+	options.omit_edges = map[string]bool{"a": cfg.NoLinkEdges, "area": cfg.NoLinkEdges, "img": cfg.NoImageEdges, "script": cfg.NoScriptEdges, "link": cfg.NoStyleEdges};
+	options.skip_extensions = make(map[string]bool);
+	for _, ext := range cfg.SkipExtensions {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			options.skip_extensions[ext] = true;
+		}
+	}
+	for _, seed := range start_urls {
+		if su, err := url.Parse(seed); err == nil && !contains(canonical_host(su), options.allowed_hosts) {
+			options.allowed_hosts = append(options.allowed_hosts, canonical_host(su));
+		}
+	}
+	for _, h := range cfg.AllowedHosts {
+		if h = strings.TrimSpace(h); h != "" {
+			options.allowed_hosts = append(options.allowed_hosts, strings.ToLower(h));
+		}
+	}
+
+	transport, err := new_transport(cfg.Proxy, cfg.Insecure);
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %v", err);
+	}
+	if (cfg.Insecure) {
+		slog.Warn("TLS certificate verification is disabled, responses may come from anyone");
+	}
+	if (site_root != "") {
+		transport.RegisterProtocol("file", static_dir{http.Dir(site_root)});
+	}
+
+	var jar http.CookieJar;
+	if (!cfg.NoCookies) {
+		/* the public suffix list stops a site setting a cookie for all of e.g. co.uk */
+		jar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List});
+		for _, c := range cfg.Cookies {
+			jar.SetCookies(cookie_url(target_base, c), []*http.Cookie{c});
+		}
+	}
+	fetcher := &Fetcher{
+		client: &http.Client{
+			Jar: jar,
+			Transport: &request_limiter{next: transport, max: cfg.MaxRequests},
+			Timeout: cfg.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return check_redirect(options, jar, req, via);
+			},
+		},
+		user_agent: cfg.UserAgent,
+		accept: cfg.Accept,
+		header: cfg.Header,
+		limiter: new_host_limiter(cfg.Delay, cfg.DelayJitter),
+		connections: new_host_connections(cfg.PerHostConnections),
+		retries: cfg.Retries,
+		username: cfg.Username,
+		password: cfg.Password,
+		options: options,
+		max_bytes: cfg.MaxBytes,
+	};
+	if (!cfg.IgnoreRobots && site_root == "") {
+		fetcher.robots = new_robots_cache();
+	}
+	if (cfg.DetectSoft404 && site_root == "") {
+		fetcher.soft_404 = new_soft_404_cache();
+	}
+
+	c := &crawl{options: options, fetcher: fetcher, base: target_base};
+	if (cfg.Sitemap != "") {
+		if start_urls, err = sitemap_start_urls(ctx, fetcher, target_base, cfg.Sitemap); err != nil {
+			return nil, err;
+		}
+	}
+	for _, seed := range start_urls {
+		c.starts = append(c.starts, seed_task(target_base, seed));
+	}
+	return c, nil;
+}
+
+/*
+Starts crawling from cfg's start page or seeds and returns the channel the results are sent on.
+Every link found is sent as a PageLink, and every page scraped as a PageLink carrying only its Report.
+The channel is closed once the crawl is over. When ctx is cancelled the pages being fetched are
+finished and the rest are left pending in cfg.State, after which the channel is closed too.
+The results must be received, since the workers wait for room on the channel.
+*/
+func Crawl(ctx context.Context, cfg Config) (<-chan PageLink, error) {
+	c, err := new_crawl(ctx, cfg);
+	if err != nil {
+		return nil, err;
+	}
+	stats := cfg.Stats;
+	if (stats == nil) {
+		stats = &CrawlStats{};
+	}
+	state := cfg.State;
+	if (state == nil) {
+		state = NewCrawlState();
+	}
+	state.rebase(c.base);
+
+	/*
+	crawl channels
+	Buffers only smooth out bursts: unbounded_buffer always receives from task_submit and task_done while it waits
+	to hand out a task, so a worker submitting links never deadlocks with it, and a slow consumer only slows the
+	workers down once results is full.
+	*/
+	task_submit := make(chan ScrapeTask, cfg.SubmitBuffer); //tasks submitted to the worker pool
+	task_queue := make(chan ScrapeTask); //tasks waiting to be retrieved by workers
+	task_done := make(chan finished_task, cfg.Workers); //notify on this channel when task is done, each worker has at most one
+	results := make(chan PageLink, cfg.ResultsBuffer); //result pagelinks to be processed
+
+	go func() {
+		unbounded_buffer(ctx, task_submit, task_queue, task_done, results, cfg.MaxPages, cfg.Order, c.options.normalize, stats, state, c.starts);
+		/* nothing is left of the crawl once the workers have gone, but the connections they kept alive */
+		c.fetcher.client.CloseIdleConnections();
+	}();
+	for n := 0; n < cfg.Workers; n++ {
+		go scrape_worker(ctx, n, cfg.MaxDepth, c.options, c.fetcher, stats, task_queue, results, task_submit, task_done)
+	}
+	return results, nil;
+}
+
+/*
+Fetches only the start pages and returns each link on them with whether it would be crawled,
+for the caller to print. A start page was scraped successfully if its Status is "Done".
+*/
+func DryRun(ctx context.Context, cfg Config) ([]DryRunPage, error) {
+	c, err := new_crawl(ctx, cfg);
+	if err != nil {
+		return nil, err;
+	}
+	pages := []DryRunPage{};
+	for _, start := range c.starts {
+		pages = append(pages, dry_run_page(ctx, c.options, c.fetcher, start, cfg.MaxDepth));
+	}
+	return pages, nil;
+}
+
+func contains(value string, list []string) bool {
+	for _, v := range list {
+		if (v == value) {
+			return true;
+		}
+	}
+	return false;
+}
+/* Creates the depth 0 task for a start url */
+func seed_task(target_base string, seed string) ScrapeTask {
+	return ScrapeTask{BaseURL: target_base, Page: page_resource(target_base, seed), URL: seed, Depth: 0, Document: true};
+}
+
+/* Labels an absolute url by its path on the target's host and by the whole url elsewhere */
+func page_resource(target_base string, target string) Resource {
+	if tu, err := url.Parse(target); err == nil {
+		if bu, err := url.Parse(target_base); err == nil && canonical_host(tu) == canonical_host(bu) {
+			return Resource(tu.RequestURI());
+		}
+	}
+	return Resource(target);
+}
+
+/* finished_task is sent on task_done by a worker, complete is false if the page was beyond the depth limit or its scrape was cancelled */
+type finished_task struct {
+	task ScrapeTask;
+	complete bool;
+	submitted int; // tasks sent on task_submit while scraping it
+	canonical string; // the page's PageReport.CanonicalURL, empty if it has none
+}
+
+/* queued_task is a ScrapeTask waiting in unbounded_buffer, seq orders tasks queued at the same depth */
+type queued_task struct {
+	task ScrapeTask;
+	seq int;
+}
+
+/*
+Priority queue of tasks for container/heap.
+Shallowest first, oldest first within a depth, or newest first when dfs is set.
+*/
+type task_heap struct {
+	items []queued_task;
+	dfs bool;
+}
+
+func (h *task_heap) Len() int { return len(h.items) }
+func (h *task_heap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *task_heap) Push(x any) { h.items = append(h.items, x.(queued_task)) }
+
+func (h *task_heap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j];
+	if (h.dfs) {
+		return a.seq > b.seq;
+	}
+	if (a.task.Depth != b.task.Depth) {
+		return a.task.Depth < b.task.Depth;
+	}
+	return a.seq < b.seq;
+}
+
+func (h *task_heap) Pop() any {
+	last := h.items[len(h.items)-1];
+	h.items = h.items[:len(h.items)-1];
+	return last;
+}
+
+/*
+Unbounded priority queue of ScrapeTasks between input and output, handing out the shallowest task first.
+Removes duplicate tasks for the same normalized url, and drops new pages once max_pages distinct pages have been queued (0 = no limit).
+With order "bfs" a task is only handed out once no shallower task is in flight, so every depth is finished before the next starts.
+With order "dfs" the most recently queued task is handed out first.
+Keeps track of the number of delegated tasks and closes the output channel, which stops the workers, and results when done.
+unfinished counts the tasks in the queue plus those handed out: it grows only when a task is pushed, so duplicates
+dropped by accept are never counted, and shrinks once per task_done or for each queued task dropped on cancellation.
+Each task_done also says how many tasks the worker submitted for it. The crawl is only over once all of those have
+been received too, so it stays correct even if a submission were still on its way when the task_done arrives.
+When ctx is cancelled the queue is dropped and further submissions are discarded, so results closes once in-flight tasks finish.
+Queued and finished pages are recorded in state for checkpoints, and the pending tasks of a resumed state are queued first.
+The seeds are queued before anything else is received, so the crawl cannot look finished before it has started.
+A page that a finished task named as its canonical url counts as visited, and is dropped from the queue if it is waiting there.
+*/
+func unbounded_buffer(ctx context.Context, input chan ScrapeTask, output chan ScrapeTask, task_done chan finished_task, results chan PageLink, max_pages int, order string, normalize *NormalizeOptions, stats *CrawlStats, state *CrawlState, seeds []ScrapeTask) {
+	queue := &task_heap{dfs: order == "dfs"};
+	seq := 0;
+	done := make(map[string]bool);
+	covered := make(map[string]bool); // canonical urls of pages already scraped
+	unfinished := 0;
+	in_flight := make(map[int]int); // depth to number of tasks handed out and not yet done
+	in_transit := 0; // tasks reported as submitted by finished tasks but not yet received, negative while the reports lag behind
+	cancel := ctx.Done(); // set to nil once cancelled
+	cancelled := false;
+
+	push := func(d ScrapeTask) {
+		heap.Push(queue, queued_task{task: d, seq: seq});
+		seq += 1;
+		unfinished += 1;
+	};
+
+	/* a resumed crawl never revisits a page, and picks up where it was interrupted */
+	state.mu.Lock();
+	for key := range state.visited {
+		done[key] = true;
+	}
+	for key, d := range state.pending {
+		done[key] = true;
+		push(d);
+	}
+	state.mu.Unlock();
+
+	/*
+	marks d as done if it is a new page, and reports whether it should be queued.
+	After cancellation new pages are only recorded as pending, for a resumed crawl to visit.
+	*/
+	accept := func(d ScrapeTask) bool {
+		key := normalize_url(d.URL, normalize);
+		if (done[key] || (max_pages > 0 && len(done) >= max_pages)) {
+			return false;
+		}
+		done[key] = true;
+		state.queued(key, d);
+		return !cancelled;
+	};
+
+	for _, d := range seeds {
+		if (accept(d)) {
+			push(d);
+		}
+	}
+
+	/* reports whether the task at the top of the queue may be handed out now */
+	ready := func() bool {
+		if (queue.Len() == 0) {
+			return false;
+		}
+		if (queue.dfs) {
+			return true;
+		}
+		if (in_transit > 0) {
+			return false;
+		}
+		for depth, n := range in_flight {
+			if (n > 0 && depth < queue.items[0].task.Depth) {
+				return false;
+			}
+		}
+		return true;
+	};
+
+	for {
+		for (queue.Len() > 0 && covered[normalize_url(queue.items[0].task.URL, normalize)]) {
+			heap.Pop(queue);
+			unfinished -= 1;
+		}
+		stats.Queued.Store(int64(queue.Len()));
+		stats.InFlight.Store(int64(unfinished - queue.Len()));
+		if (queue.Len() == 0 && unfinished == 0 && in_transit == 0) {
+			close(output);
+			close(results);
+			return;
+		}
+
+		/* a nil channel is never ready, so nothing is handed out until ready() */
+		var out chan ScrapeTask;
+		var task ScrapeTask;
+		if (ready()) {
+			out = output;
+			task = queue.items[0].task;
+		}
+
+		select {
+		case d := <- input:
+			in_transit -= 1;
+			if (accept(d)) {
+				push(d);
+			}
+		case out <- task:
+			heap.Pop(queue);
+			in_flight[task.Depth] += 1;
+		case f := <- task_done:
+			unfinished -= 1;
+			in_transit += f.submitted;
+			in_flight[f.task.Depth] -= 1;
+			state.finished(normalize_url(f.task.URL, normalize), f.complete);
+			if (f.canonical != "") {
+				key := normalize_url(f.canonical, normalize);
+				covered[key], done[key] = true, true;
+				state.finished(key, true);
+			}
+		case <- cancel:
+			cancel = nil;
+			cancelled = true;
+			unfinished -= queue.Len();
+			queue.items = nil;
+		}
+	}
+}
+
+/* NormalizeOptions control which urls are considered the same page */
+type NormalizeOptions struct {
+	sort_query bool;
+	ignore_query bool; // drop the whole query string
+	ignore_params map[string]bool; // query parameters to drop, e.g. tracking parameters
+}
+
+/*
+Normalizes an absolute url for deduplication: drops the fragment, an empty query
+and a trailing slash, lowercases the scheme and host and removes the default port.
+Unparseable urls are returned unchanged.
+*/
+func normalize_url(raw string, opts *NormalizeOptions) string {
+	u, err := url.Parse(strip_query(raw, opts));
+	if err != nil {
+		return raw;
+	}
+	u.Scheme = strings.ToLower(u.Scheme);
+	u.Host = canonical_host(u);
+	u.Fragment = "";
+	u.RawFragment = "";
+	u.ForceQuery = false;
+	if (opts.sort_query && u.RawQuery != "") {
+		u.RawQuery = sorted_query(u.Query());
+	}
+	if (len(u.Path) > 1) {
+		u.Path = strings.TrimSuffix(u.Path, "/");
+		u.RawPath = "";
+	}
+	if (u.Path == "") {
+		u.Path = "/";
+	}
+	return u.String();
+}
+
+/*
+Drops the query string from a url or href with ignore_query, or otherwise the ignored parameters, keeping the rest in order.
+Leaves anything after a # alone, so it should be called once the fragment has been removed.
+*/
+func strip_query(raw string, opts *NormalizeOptions) string {
+	i := strings.Index(raw, "?");
+	if (i < 0 || (!opts.ignore_query && len(opts.ignore_params) == 0)) {
+		return raw;
+	}
+	if (opts.ignore_query) {
+		return raw[:i];
+	}
+	kept := []string{};
+	for _, param := range strings.Split(raw[i+1:], "&") {
+		name := param;
+		if j := strings.Index(param, "="); j >= 0 {
+			name = param[:j];
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped;
+		}
+		if (!opts.ignore_params[name]) {
+			kept = append(kept, param);
+		}
+	}
+	if (len(kept) == 0) {
+		return raw[:i];
+	}
+	return raw[:i] + "?" + strings.Join(kept, "&");
+}
+
+/* Encodes query values with keys sorted, keeping the order of repeated keys */
+func sorted_query(values url.Values) string {
+	keys := make([]string, 0, len(values));
+	for k := range values {
+		keys = append(keys, k);
+	}
+	sort.Strings(keys);
+	parts := []string{};
+	for _, k := range keys {
+		for _, v := range values[k] {
+			parts = append(parts, url.QueryEscape(k) + "=" + url.QueryEscape(v));
+		}
+	}
+	return strings.Join(parts, "&");
+}
+
+/*
+Scrape Workers take tasks from the task_queue, scrape the page, adding results to results and newly discovered pages to task_submit. Signals on task_done when the task is done to facilitate clean program termination.
+Every task received gets exactly one task_done, also when it is beyond the depth limit or fails, and only after
+all of its results and submissions have been sent, so unbounded_buffer never closes results under a worker.
+The worker returns once task_queue is closed at the end of the crawl.
+*/
+func scrape_worker(ctx context.Context, worker_id int, max_depth int, options *ScrapeOptions, fetcher *Fetcher, stats *CrawlStats, task_queue chan ScrapeTask, results chan PageLink, task_submit chan ScrapeTask, task_done chan finished_task) {
+	out := &channel_collector{results: results, task_submit: task_submit};
+	for {
+		task, ok := <- task_queue;
+		if (!ok) {
+			return;
+		}
+		out.submitted = 0;
+		complete := false;
+		canonical := "";
+		if(within_limit(task, max_depth)) {
+			report := &PageReport{Page: task.Page, Depth: task.Depth, External: task.External};
+			report.Status = scrape(ctx, worker_id, options, fetcher, task, report, out);
+			if (IsBroken(report)) {
+				slog.Warn(report.Status, "worker", worker_id, "page", string(task.Page), "url", report.URL);
+			} else {
+				slog.Debug(report.Status, "worker", worker_id, "page", string(task.Page), "url", report.URL);
+			}
+			out.add_link(PageLink{To: task.Page, URL: report.URL, Report: report});
+			stats.Crawled.Add(1);
+			complete = report.Status != "Cancelled" && report.Status != status_request_limit;
+			canonical = report.CanonicalURL;
+		}
+		task_done <- finished_task{task: task, complete: complete, submitted: out.submitted, canonical: canonical};
+	}
+}
+
+/*
+Collector receives what scrape finds on a page: links to record in the graph and tasks for the pages to crawl.
+The workers send them on to the program channels, a test can collect them into slices instead.
+*/
+type Collector interface {
+	add_link(pl PageLink);
+	add_task(task ScrapeTask);
+}
+
+type channel_collector struct {
+	results chan PageLink;
+	task_submit chan ScrapeTask;
+	submitted int; // tasks sent since the worker last reset it
+}
+
+func (c *channel_collector) add_link(pl PageLink) { c.results <- pl }
+func (c *channel_collector) add_task(task ScrapeTask) { c.task_submit <- task; c.submitted += 1 }
+
+/* nofollow_collector records the links of a page whose <meta name="robots"> says nofollow, but drops its tasks */
+type nofollow_collector struct {
+	Collector;
+}
+
+func (c nofollow_collector) add_task(task ScrapeTask) {}
+
+/*
+Reports whether a task at the given depth should be scraped.
+A task's depth is the number of link hops from the start page, so the start page (depth 0) is always scraped.
+A negative max_depth means unlimited.
+*/
+func within_depth(depth int, max_depth int) bool {
+	return depth == 0 || max_depth < 0 || depth <= max_depth;
+}
+
+/* Reports whether a worker should handle the task: pages within the depth limit, and external links found on them */
+func within_limit(task ScrapeTask, max_depth int) bool {
+	return within_depth(task.Depth, max_depth) || (task.External && within_depth(task.Depth - 1, max_depth));
+}
+
+/* Returns why u must not be fetched, or "" if it may be. An external link being checked may be on any host */
+func fetch_rejection(ctx context.Context, options *ScrapeOptions, fetcher *Fetcher, u *url.URL, external bool) string {
+	if(!external && !host_allowed(options, u)) {
+		return "Rejected due to hostname=" + string(u.Host) + " (not an allowed host)";
+	}
+	if(u.Scheme != "http" && u.Scheme != "https" && !(u.Scheme == "file" && options.file_source)) {
+		return "Rejected due to scheme=" + string(u.Scheme);
+	}
+	if (fetcher.robots != nil && !robots_allowed(robots_rules_for(ctx, fetcher, u), u.RequestURI())) {
+		return "Rejected by robots.txt";
+	}
+	return "";
+}
+
+/*
+Fetches the task's page with fetcher's client and passes the links found on it to out, filling in report.
+Returns the status printed by the worker. Needs no channels, so it can be run against an httptest server.
+*/
+func scrape(ctx context.Context, worker_id int, options *ScrapeOptions, fetcher *Fetcher, task ScrapeTask, report *PageReport, out Collector) string {
+	newurl := task.URL;
+	report.URL = newurl;
+
+	u, err := url.Parse(newurl);
+	if err != nil {
+		return "Rejected: malformed URL";
+	}
+	if reason := fetch_rejection(ctx, options, fetcher, u, task.External); reason != "" {
+		return reason;
+	}
+
+	/*
+	a page seen by an earlier crawl is only sent again if it changed since. Not with obey_nofollow or obey_meta_robots,
+	as the saved links do not say which of them were nofollow.
+	*/
+	header := make(http.Header);
+	prev, has_prev := options.previous[task.URL];
+	replayable := !options.obey_nofollow && !options.obey_meta_robots;
+	conditional := has_prev && replayable && !task.Head && !task.External && (prev.ETag != "" || !prev.LastModified.IsZero());
+	if (conditional) {
+		if (prev.ETag != "") {
+			header.Set("If-None-Match", prev.ETag);
+		}
+		if (!prev.LastModified.IsZero()) {
+			header.Set("If-Modified-Since", prev.LastModified.UTC().Format(http.TimeFormat));
+		}
+	}
+	/* only pages are asked for a type, stylesheets, scripts, assets and external links may be anything */
+	if (fetcher.accept != "" && task.Document && !task.Head && !task.External && fetcher.header.Get("Accept") == "") {
+		header.Set("Accept", fetcher.accept);
+	}
+
+	crawl_delay := time.Duration(0);
+	if (fetcher.robots != nil) {
+		crawl_delay = robots_rules_for(ctx, fetcher, u).delay;
+	}
+	release, ok := connections_acquire(ctx, fetcher.connections, canonical_host(u));
+	if (!ok) {
+		return "Cancelled";
+	}
+	defer release();
+	var resp *http.Response;
+	var chain *redirect_chain;
+	var start time.Time;
+	for attempt := 0; ; attempt++ {
+		if (!limiter_wait(ctx, fetcher.limiter, canonical_host(u), crawl_delay)) {
+			return "Cancelled";
+		}
+		start = time.Now();
+		var cancel context.CancelFunc;
+		method := "GET";
+		if (task.Head) {
+			method = "HEAD";
+		}
+		resp, chain, cancel, err = do_request(ctx, fetcher, method, newurl, header);
+		defer cancel();
+
+		/* connection errors and 5xx responses may be transient, 4xx are not */
+		reason := "";
+		if (err != nil && ctx.Err() == nil && !errors.Is(err, err_redirect_loop) && !errors.Is(err, err_too_many_redirects) && !errors.Is(err, err_request_limit)) {
+			reason = request_error_status(err);
+		} else if (err == nil && resp.StatusCode >= 500) {
+			reason = "HTTP " + strconv.Itoa(resp.StatusCode);
+			resp.Body.Close();
+		}
+		if (reason == "" || attempt >= fetcher.retries) {
+			break;
+		}
+		backoff := retry_backoff << uint(attempt);
+		slog.Warn("Retrying", "worker", worker_id, "page", string(task.Page), "url", newurl, "reason", reason, "attempt", attempt + 1, "backoff", backoff);
+		if (!sleep_ctx(ctx, backoff)) {
+			return "Cancelled";
+		}
+	}
+	if err != nil {
+		if (ctx.Err() != nil) {
+			return "Cancelled";
+		}
+		if (errors.Is(err, err_request_limit)) {
+			return status_request_limit;
+		}
+		report.FetchError = true;
+		report.Err = describe_request_error(err);
+		return request_error_status(err);
+	}
+	defer resp.Body.Close()
+
+	/* an asset that turns out to be something we scrape, or whose server refuses HEAD, is fetched after all */
+	if (task.Head) {
+		ok := resp.StatusCode >= 200 && resp.StatusCode <= 299;
+		if ((ok && !task.External && scrapeable(options, resp.Header.Get("Content-Type"))) || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+			resp.Body.Close();
+			release();
+			task.Head = false;
+			return scrape(ctx, worker_id, options, fetcher, task, report, out);
+		}
+	}
+
+	counter := &counting_reader{r: resp.Body};
+	resp.Body = io.NopCloser(counter);
+	defer func() {
+		report.Duration = time.Since(start);
+		report.Bytes = counter.n;
+	}();
+
+	/* record each redirect hop as an edge, links on the page belong to where we landed */
+	for _, hop := range chain.hops {
+		report.Redirects = append(report.Redirects, hop.String());
+		if (task.External) {
+			/* the hops of an external link are not pages of the site */
+			continue;
+		}
+		to := page_resource(task.BaseURL, hop.String());
+		out.add_link(PageLink{From: task.Page, To: to, URL: hop.String(), Depth: task.Depth, Kind: "redirect"});
+		task.Page = to;
+	}
+	report.Final = task.Page;
+	if (chain.rejected != "") {
+		return chain.rejected;
+	}
+
+	report.Code = resp.StatusCode;
+	if (resp.StatusCode == http.StatusNotModified && conditional && len(chain.hops) == 0) {
+		report.NotModified = true;
+		report.Title, report.ContentType, report.Hash = prev.Title, prev.ContentType, prev.Hash;
+		report.LastModified, report.ETag = prev.LastModified, prev.ETag;
+		replay_links(options, task, prev.Links, out);
+		return "Not modified";
+	}
+	if(resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return "HTTP " + strconv.Itoa(resp.StatusCode);
+	}
+	contentType := resp.Header.Get("Content-Type");
+	report.ContentType = contentType;
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		report.LastModified = modified;
+	}
+	report.ETag = resp.Header.Get("ETag");
+	if (task.Head) {
+		return "Checked with HEAD, content-type=" + contentType;
+	}
+	if (task.External) {
+		return "Checked with GET, content-type=" + contentType;
+	}
+	if(!scrapeable(options, contentType)) {
+		return "Rejected due to content-type=" + contentType;
+	}
+	stylesheet := options.crawl_css && is_css(contentType);
+	script := options.scan_js && is_js(contentType);
+
+	/* links resolve against the page we landed on, or its <base href> once seen */
+	link_base := resp.Request.URL.String();
+	seen_base := false;
+
+	if (fetcher.max_bytes > 0 && resp.ContentLength > fetcher.max_bytes) {
+		return "Rejected: body too large";
+	}
+	body, err := response_body(resp);
+	if err != nil {
+		return "Rejected due to invalid " + resp.Header.Get("Content-Encoding") + " body";
+	}
+	defer body.Close();
+
+	/* pages with identical bodies are reported as duplicates */
+	hasher := sha256.New();
+
+	/* a compressed body can expand well past its Content-Length, so limit what is decoded */
+	limited := &counting_reader{r: io.TeeReader(body, hasher)};
+	if (fetcher.max_bytes > 0) {
+		limited.r = io.LimitReader(limited.r, fetcher.max_bytes + 1);
+	}
+
+	/* the body is kept as it is read, so that the page can be saved without fetching it again */
+	var mirror *bytes.Buffer;
+	if (options.mirror != "" && !stylesheet && !script) {
+		mirror = &bytes.Buffer{};
+		limited.r = io.TeeReader(limited.r, mirror);
+	}
+
+	/* decode to UTF-8 using the charset from the Content-Type header or the page's <meta charset> */
+	var page io.Reader = limited;
+	if decoded, err := charset.NewReader(limited, contentType); err == nil {
+		page = decoded;
+	}
+
+	if (stylesheet) {
+		return scrape_css(options, task, page, limited, fetcher.max_bytes, link_base, out);
+	}
+	if (script) {
+		return scrape_js(options, task, page, limited, fetcher.max_bytes, link_base, out);
+	}
+
+	z := html.NewTokenizer(page)
+
+	/* records a link found in the given tag, unless edges are not wanted for it */
+	record := func(tag string, pl PageLink) {
+		if (pl.Kind == "") {
+			pl.Kind = link_kinds[tag];
+		}
+		if (!options.omit_edges[tag]) {
+			out.add_link(pl);
+		}
+	};
+
+	/* a link from <a> is recorded at its </a>, once its text is known */
+	var anchor *PageLink;
+	var anchor_text strings.Builder;
+	end_anchor := func() {
+		if (anchor != nil) {
+			anchor.Text = strings.Join(strings.Fields(anchor_text.String()), " ");
+			record("a", *anchor);
+			anchor = nil;
+		}
+		anchor_text.Reset();
+	};
+
+	for {
+	    tt := z.Next()
+
+	    switch {
+	    case tt == html.TextToken:
+	    	if (anchor != nil) {
+	    		anchor_text.Write(z.Text());
+	    		anchor_text.WriteString(" ");
+	    	}
+	    case tt == html.EndTagToken:
+	    	if name, _ := z.TagName(); string(name) == "a" {
+	    		end_anchor();
+	    	}
+	    case tt == html.ErrorToken:
+	    	end_anchor();
+	    	if (fetcher.max_bytes > 0 && limited.n > fetcher.max_bytes) {
+	    		return "Rejected: body too large";
+	    	}
+	    	if (z.Err() == io.EOF) {
+	    		report.Hash = hex.EncodeToString(hasher.Sum(nil));
+	    		if (mirror != nil) {
+	    			if err := save_mirror(options.mirror, resp.Request.URL, mirror.Bytes()); err != nil {
+	    				slog.Warn("Cannot save page to the mirror", "page", string(report.Final), "err", err);
+	    			}
+	    		}
+	    		if (fetcher.soft_404 != nil && is_soft_404(soft_404_for(ctx, fetcher, resp.Request.URL), report, resp.Request.URL.String(), limited.n)) {
+	    			report.Soft404 = true;
+	    			return "Soft 404, looks like the host's not found page";
+	    		}
+	    	}
+	    	return "Done";
+	    case tt == html.StartTagToken || tt == html.SelfClosingTagToken:
+	        /* void elements like <img> are start tags unless written as <img /> */
+	        t := z.Token()
+
+	        if t.Data == "title" && report.Title == "" && tt == html.StartTagToken {
+	        	if (z.Next() == html.TextToken) {
+	        		report.Title = strings.Join(strings.Fields(z.Token().Data), " ");
+	        	}
+	        }
+	        if t.Data == "base" && !seen_base {
+	        	for _, a := range t.Attr {
+	        		if a.Key == "href" {
+	        			if base, err := fix_url(link_base, a.Val); err == nil {
+	        				link_base = base;
+	        			}
+	        			seen_base = true;
+	        			break
+	        		}
+	        	}
+	        }
+	        if t.Data == "meta" && options.obey_meta_robots {
+	        	if name, _ := attr_value(t, "name"); strings.EqualFold(name, "robots") {
+	        		content, _ := attr_value(t, "content");
+	        		noindex, nofollow := meta_robots(content);
+	        		report.NoIndex = report.NoIndex || noindex;
+	        		if _, done := out.(nofollow_collector); nofollow && !done {
+	        			slog.Debug("Not following links, <meta name=\"robots\"> says nofollow", "page", string(task.Page));
+	        			out = nofollow_collector{out};
+	        		}
+	        	}
+	        }
+	        if t.Data == "a" {
+	        	/* an <a> inside another closes it, as browsers do */
+	        	end_anchor();
+	        }
+	        if t.Data == "img" && anchor != nil {
+	        	if alt, ok := attr_value(t, "alt"); ok {
+	        		anchor_text.WriteString(alt + " ");
+	        	}
+	        }
+	        if t.Data == "a" || t.Data == "area" {
+	            for _, a := range t.Attr {
+				    if a.Key == "href" {
+				    	if pl, ok := new_link(options, task, link_base, a.Val); ok {
+				    		pl.Kind = link_kinds[t.Data];
+				    		if (options.obey_nofollow && rel_contains(t, "nofollow")) {
+				    			slog.Debug("Skipped, rel=nofollow", "page", string(pl.To), "url", pl.URL, "from", string(task.Page));
+				    		} else {
+				    			follow(options, task, pl, out);
+				    		}
+				    		if (t.Data == "a" && tt == html.StartTagToken) {
+				    			anchor = &pl;
+				    		} else {
+				    			pl.Text, _ = attr_value(t, "alt");
+				    			record(t.Data, pl);
+				    		}
+				    	}
+				        break
+				    }
+				}
+	        }
+	        if t.Data == "link" {
+	        	for _, a := range t.Attr {
+	        		if a.Key == "href" {
+	        			if pl, ok := new_link(options, task, link_base, a.Val); ok {
+	        				if (rel_contains(t, "stylesheet")) {
+	        					pl.Kind = "stylesheet";
+	        				}
+	        				if (options.use_canonical && report.Canonical == "" && !pl.External && rel_contains(t, "canonical") && normalize_url(pl.URL, options.normalize) != normalize_url(resp.Request.URL.String(), options.normalize)) {
+	        					/* the links after it belong to the canonical page, as those after a redirect belong to where it landed */
+	        					report.Canonical, report.CanonicalURL = pl.To, pl.URL;
+	        					task.Page = report.Canonical;
+	        					slog.Debug("Page names another url as canonical", "page", string(report.Final), "canonical", pl.URL);
+	        				}
+	        				if (options.crawl_css && pl.Kind == "stylesheet") {
+	        					follow(options, task, pl, out);
+	        				} else {
+	        					check_asset(options, task, pl, out);
+	        				}
+	        				record("link", pl);
+	        			}
+	        		}
+	        	}
+	        }
+	        if t.Data == "script" && options.scan_js {
+	        	if src, ok := attr_value(t, "src"); ok {
+	        		if pl, ok := new_link(options, task, link_base, src); ok {
+	        			follow(options, task, pl, out);
+	        		}
+	        	} else if (tt == html.StartTagToken && z.Next() == html.TextToken) {
+	        		for _, ref := range js_urls(z.Token().Data) {
+	        			if pl, ok := new_link(options, task, link_base, ref); ok {
+	        				record("script", pl);
+	        			}
+	        		}
+	        	}
+	        }
+	        if t.Data == "iframe" || t.Data == "embed" || t.Data == "source" || t.Data == "object" {
+	        	key := "src";
+	        	if (t.Data == "object") {
+	        		key = "data";
+	        	}
+	        	if ref, ok := attr_value(t, key); ok {
+	        		if pl, ok := new_link(options, task, link_base, ref); ok {
+	        			if (t.Data == "iframe" && options.follow_iframes) {
+	        				pl.Kind = "frame";
+	        				follow(options, task, pl, out);
+	        			} else {
+	        				check_asset(options, task, pl, out);
+	        			}
+	        			record(t.Data, pl);
+	        		}
+	        	}
+	        }
+	        if t.Data == "img" || t.Data == "source" {
+	        	if srcset, ok := attr_value(t, "srcset"); ok {
+	        		for _, ref := range srcset_urls(srcset) {
+	        			if pl, ok := new_link(options, task, link_base, ref); ok {
+	        				check_asset(options, task, pl, out);
+	        				record(t.Data, pl);
+	        			}
+	        		}
+	        	}
+	        }
+	        if t.Data == "script" || t.Data == "img" {
+	        	for _, a := range t.Attr {
+	        		if a.Key == "src" {
+	        			if pl, ok := new_link(options, task, link_base, a.Val); ok {
+	        				check_asset(options, task, pl, out);
+	        				record(t.Data, pl);
+	        			}
+	        		}
+	        	}
+	        }
+	    }
+	}
+}
+
+/*
+
+==================================
+
+Stylesheet scanning
+
+With -crawl-css, stylesheets are fetched like pages and every url(...) and @import they
+reference is recorded as an edge from the stylesheet. Imported stylesheets are queued too.
+
+*/
+
+var css_url_pattern = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`);
+var css_import_pattern = regexp.MustCompile(`@import\s+(?:"([^"]*)"|'([^']*)')`);
+
+/* Records the references in a stylesheet, resolving them against the stylesheet's own url */
+func scrape_css(options *ScrapeOptions, task ScrapeTask, page io.Reader, limited *counting_reader, max_bytes int64, link_base string, out Collector) string {
+	css, err := io.ReadAll(page);
+	if err != nil {
+		return "HTTP error";
+	}
+	if (max_bytes > 0 && limited.n > max_bytes) {
+		return "Rejected: body too large";
+	}
+
+	for _, m := range css_import_pattern.FindAllSubmatch(css, -1) {
+		if pl, ok := new_link(options, task, link_base, first_group(m)); ok {
+			follow(options, task, pl, out);
+			pl.Kind = "stylesheet";
+			out.add_link(pl);
+		}
+	}
+	for _, m := range css_url_pattern.FindAllSubmatch(css, -1) {
+		ref := first_group(m);
+		if (strings.HasPrefix(strings.ToLower(ref), "data:")) {
+			continue;
+		}
+		if pl, ok := new_link(options, task, link_base, ref); ok {
+			check_asset(options, task, pl, out);
+			pl.Kind = "asset";
+			out.add_link(pl);
+		}
+	}
+	return "Done";
+}
+
+/* Returns the first non-empty capture group of a regexp match */
+func first_group(match [][]byte) string {
+	for _, g := range match[1:] {
+		if (len(g) > 0) {
+			return string(g);
+		}
+	}
+	return "";
+}
+
+/*
+
+==================================
+
+Script scanning
+
+With -scan-js, string literals in scripts that look like urls or paths are recorded as edges.
+This is a heuristic: it finds strings that are never requested (e.g. route patterns, or
+paths only meant for display) and misses urls that are built at run time.
+
+*/
+
+const js_url = `((?:https?:)?//[^\s"'<>\\]+|/[^\s"'<>\\/][^\s"'<>\\]*|[\w\-./]+\.(?:html?|php|aspx?|js|css|json|xml|png|jpe?g|gif|svg|webp|ico|woff2?|ttf|pdf))`;
+
+var js_url_pattern = regexp.MustCompile(`"` + js_url + `"|'` + js_url + `'|` + "`" + js_url + "`");
+
+/* Returns the url-like string literals in a script */
+func js_urls(script string) []string {
+	urls := []string{};
+	for _, m := range js_url_pattern.FindAllStringSubmatch(script, -1) {
+		for _, g := range m[1:] {
+			if (g != "") {
+				urls = append(urls, g);
+				break;
+			}
+		}
+	}
+	return urls;
+}
+
+/* Records the url-like string literals in an external script, which are not crawled */
+func scrape_js(options *ScrapeOptions, task ScrapeTask, page io.Reader, limited *counting_reader, max_bytes int64, link_base string, out Collector) string {
+	script, err := io.ReadAll(page);
+	if err != nil {
+		return "HTTP error";
+	}
+	if (max_bytes > 0 && limited.n > max_bytes) {
+		return "Rejected: body too large";
+	}
+	for _, ref := range js_urls(string(script)) {
+		if pl, ok := new_link(options, task, link_base, ref); ok {
+			pl.Kind = "script";
+			out.add_link(pl);
+		}
+	}
+	return "Done";
+}
+
+/*
+
+==================================
+
+Redirect handling
+
+check_redirect follows redirects to allowed hosts, recording each hop in the
+redirect_chain stored in the request's context. A redirect back to a url already
+visited is only a loop if it would send the same cookies, so a landing page that
+sets a session cookie and redirects back works.
+
+*/
+
+/* redirects followed when the Config does not say, as many as net/http allows by default */
+const default_max_redirects = 10;
+
+/* wait before the first retry, doubled for each one after */
+const retry_backoff = 500 * time.Millisecond;
+
+var err_redirect_loop = errors.New("redirect loop");
+var err_too_many_redirects = errors.New("too many redirects");
+var err_request_limit = errors.New("request limit reached");
+
+/* the status of a page that was not fetched because the request limit was reached, it stays pending in checkpoints */
+const status_request_limit = "Not fetched, -maxrequests reached";
+
+type redirect_chain struct {
+	hops []*url.URL;
+	rejected string; // why the last redirect was not followed, empty if it was
+}
+
+type redirect_chain_key struct{};
+
+func check_redirect(options *ScrapeOptions, jar http.CookieJar, req *http.Request, via []*http.Request) error {
+	chain, _ := req.Context().Value(redirect_chain_key{}).(*redirect_chain);
+
+	cookies := cookie_header(jar, req.URL);
+	for _, v := range via {
+		if (v.URL.String() == req.URL.String() && v.Header.Get("Cookie") == cookies) {
+			return err_redirect_loop;
+		}
+	}
+	/* via holds the first request and every redirect followed so far */
+	if (len(via) > options.max_redirects) {
+		return err_too_many_redirects;
+	}
+	/* only the check of an external link starts on a host that is not allowed, and it may be redirected anywhere */
+	external := !host_allowed(options, via[0].URL);
+	if (!external && !host_allowed(options, req.URL)) {
+		if (chain != nil) {
+			chain.rejected = "Rejected redirect to hostname=" + req.URL.Host;
+		}
+		return http.ErrUseLastResponse;
+	}
+	if (chain != nil) {
+		chain.hops = append(chain.hops, req.URL);
+	}
+	return nil;
+}
+
+/* Returns the url a cookie given in the Config is set from: the target's, on the cookie's domain if it has one */
+func cookie_url(target_base string, c *http.Cookie) *url.URL {
+	u, err := url.Parse(target_base);
+	if err != nil {
+		u = &url.URL{Scheme: "http"};
+	}
+	u = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"};
+	if (c.Domain != "") {
+		u.Host = strings.TrimPrefix(c.Domain, ".");
+	}
+	return u;
+}
+
+/* Returns the Cookie header the jar will send with a request for u, "" without a jar */
+func cookie_header(jar http.CookieJar, u *url.URL) string {
+	if (jar == nil) {
+		return "";
+	}
+	r := &http.Request{Header: make(http.Header)};
+	for _, c := range jar.Cookies(u) {
+		r.AddCookie(c);
+	}
+	return r.Header.Get("Cookie");
+}
+
+/* Reports whether the host of u is one of the allowed hosts, or a subdomain of one if include_subdomains is set */
+func host_allowed(options *ScrapeOptions, u *url.URL) bool {
+	host := canonical_host(u);
+	for _, h := range options.allowed_hosts {
+		if (host == h || (options.include_subdomains && strings.HasSuffix(host, "." + h))) {
+			return true;
+		}
+	}
+	return false;
+}
+
+/*
+Returns the host of u for comparing with other hosts: lower case and without the default port of its scheme,
+so http://Example.com:80/ and http://example.com/ are on the same host. IPv6 literals keep their brackets, e.g. [::1]:8080.
+*/
+func canonical_host(u *url.URL) string {
+	host := strings.TrimSuffix(strings.ToLower(u.Host), ":");
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":" + port);
+	}
+	return host;
+}
+
+/* Returns the host of u the way the crawler compares hosts, see canonical_host */
+func CanonicalHost(u *url.URL) string {
+	return canonical_host(u);
+}
+
+/* Reports whether an absolute url is on an allowed host */
+func is_internal(options *ScrapeOptions, raw string) bool {
+	u, err := url.Parse(raw);
+	return err == nil && host_allowed(options, u);
+}
+
+/* Reports whether a Content-Type header is text/html, ignoring case and parameters such as charset */
+func IsHTML(content_type string) bool {
+	/* a malformed parameter still yields the media type */
+	media_type, _, _ := mime.ParseMediaType(content_type);
+	return media_type == "text/html";
+}
+
+func is_js(content_type string) bool {
+	media_type, _, _ := mime.ParseMediaType(content_type);
+	switch media_type {
+	case "application/javascript", "text/javascript", "application/x-javascript", "application/ecmascript", "text/ecmascript":
+		return true;
+	}
+	return false;
+}
+
+func is_css(content_type string) bool {
+	media_type, _, _ := mime.ParseMediaType(content_type);
+	return media_type == "text/css";
+}
+
+/* Reports whether a response of this Content-Type is scraped for links: html, and stylesheets or scripts when those are scanned */
+func scrapeable(options *ScrapeOptions, content_type string) bool {
+	return IsHTML(content_type) || (options.crawl_css && is_css(content_type)) || (options.scan_js && is_js(content_type));
+}
+
+/* Returns the value of the tag's first attribute named key */
+func attr_value(t html.Token, key string) (string, bool) {
+	for _, a := range t.Attr {
+		if (a.Key == key) {
+			return a.Val, true;
+		}
+	}
+	return "", false;
+}
+
+/*
+The PageLink.Kind of the links found in each tag. A <link> is "stylesheet" instead when its rel says so,
+as are @imports in stylesheets, and their url() references are "asset".
+*/
+var link_kinds = map[string]string{
+	"a": "anchor",
+	"area": "anchor",
+	"img": "image",
+	"script": "script",
+	"link": "link",
+	"iframe": "frame",
+	"embed": "media",
+	"object": "media",
+	"source": "media",
+};
+
+/*
+Queues the target of a link found on task's page, unless the options say it should not be crawled.
+Whatever the tag, the target is one hop deeper than the page, so stylesheets, iframes and HEAD checks of assets
+count towards the depth limit like <a> links do.
+*/
+func follow(options *ScrapeOptions, task ScrapeTask, pl PageLink, out Collector) {
+	if reason := skip_reason(options, pl.URL); reason != "" {
+		slog.Debug(reason, "page", string(pl.To), "url", pl.URL, "from", string(task.Page));
+		return;
+	}
+	if (options.check_external && pl.External) {
+		out.add_task(ScrapeTask{BaseURL: task.BaseURL, Page: pl.To, URL: pl.URL, Depth: task.Depth + 1, Head: true, External: true});
+		return;
+	}
+	document := pl.Kind == "anchor" || pl.Kind == "frame";
+	out.add_task(ScrapeTask{BaseURL: task.BaseURL, Page: pl.To, URL: pl.URL, Depth: task.Depth + 1, Head: options.skip_extensions[url_extension(pl.URL)], Document: document});
+}
+
+/*
+Sends the links an earlier crawl found on a page that has not changed since, as if they had been found again.
+Links are followed by their kind, the way scrape follows them; a rel="nofollow" or <meta name="robots"> nofollow
+is not remembered though, so with those options such links are crawled once the page is unchanged.
+*/
+func replay_links(options *ScrapeOptions, task ScrapeTask, links []PageLink, out Collector) {
+	for _, pl := range links {
+		pl.From = task.Page;
+		pl.Depth = task.Depth + 1;
+		pl.External = !is_internal(options, pl.URL);
+		switch {
+		case pl.Kind == "anchor", pl.Kind == "stylesheet" && options.crawl_css, pl.Kind == "frame" && options.follow_iframes:
+			follow(options, task, pl, out);
+		case pl.Kind != "redirect":
+			check_asset(options, task, pl, out);
+		}
+		out.add_link(pl);
+	}
+}
+
+/* With head_assets, queues a HEAD check of an asset link that is otherwise only recorded, such as an <img src> */
+func check_asset(options *ScrapeOptions, task ScrapeTask, pl PageLink, out Collector) {
+	if (options.head_assets && options.skip_extensions[url_extension(pl.URL)]) {
+		follow(options, task, pl, out);
+	}
+}
+
+/* Returns why a discovered url should not be queued, or "" if it should */
+func skip_reason(options *ScrapeOptions, target string) string {
+	external := !is_internal(options, target);
+	if (external && options.record_external && !options.check_external) {
+		return "Skipped external link";
+	}
+	for _, re := range options.exclude {
+		if (re.MatchString(target)) {
+			return "Skipped due to -exclude=" + re.String();
+		}
+	}
+	checked := external && options.check_external;
+	if (!checked && !in_scope(options, target)) {
+		return "Skipped, outside -scope-prefix=" + options.scope_prefix;
+	}
+	if ext := url_extension(target); options.skip_extensions[ext] && !options.head_assets && !checked {
+		return "Skipped ." + ext + " file due to -skip-extensions";
+	}
+	if (len(options.include) > 0) {
+		for _, re := range options.include {
+			if (re.MatchString(target)) {
+				return "";
+			}
+		}
+		return "Skipped, matches no -include pattern";
+	}
+	return "";
+}
+
+/* Reports whether the url's path starts with the scope prefix, if there is one */
+func in_scope(options *ScrapeOptions, target string) bool {
+	if (options.scope_prefix == "") {
+		return true;
+	}
+	u, err := url.Parse(target);
+	return err == nil && strings.HasPrefix(u.Path, options.scope_prefix);
+}
+
+/* Returns the lower case extension of the url's path without the dot, e.g. "pdf" for /a/report.PDF?v=2 */
+func url_extension(target string) string {
+	u, err := url.Parse(target);
+	if err != nil {
+		return "";
+	}
+	return strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."));
+}
+
+/*
+Returns the candidate urls of a srcset attribute, e.g. a.png and b.png for "a.png 1x, b.png 640w".
+A url runs until whitespace, so one containing commas such as a data: url stays whole,
+and the descriptors after it run until the next comma.
+*/
+func srcset_urls(srcset string) []string {
+	urls := []string{};
+	rest := srcset;
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r\f,");
+		if (rest == "") {
+			return urls;
+		}
+		end := strings.IndexAny(rest, " \t\n\r\f");
+		if (end < 0) {
+			end = len(rest);
+		}
+		candidate := rest[:end];
+		rest = rest[end:];
+		if (strings.HasSuffix(candidate, ",")) {
+			candidate = strings.TrimRight(candidate, ",");
+		} else if i := strings.Index(rest, ","); i >= 0 {
+			rest = rest[i+1:];
+		} else {
+			rest = "";
+		}
+		urls = append(urls, candidate);
+	}
+}
+
+/* Returns whether the content of a <meta name="robots"> tag, e.g. "noindex, nofollow", contains noindex and nofollow; "none" means both */
+func meta_robots(content string) (noindex bool, nofollow bool) {
+	for _, directive := range strings.Split(content, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "noindex":
+			noindex = true;
+		case "nofollow":
+			nofollow = true;
+		case "none":
+			noindex, nofollow = true, true;
+		}
+	}
+	return noindex, nofollow;
+}
+
+/* Reports whether the tag's rel attribute contains value, e.g. rel="nofollow noopener" contains "nofollow" */
+func rel_contains(t html.Token, value string) bool {
+	for _, a := range t.Attr {
+		if (a.Key == "rel") {
+			for _, v := range strings.Fields(a.Val) {
+				if (strings.EqualFold(v, value)) {
+					return true;
+				}
+			}
+		}
+	}
+	return false;
+}
+
+/* Returns the lower case scheme of an absolute url, e.g. "mailto" */
+func url_scheme(target string) string {
+	if i := strings.Index(target, ":"); i >= 0 {
+		return strings.ToLower(target[:i]);
+	}
+	return "";
+}
+
+/*
+Creates the PageLink for an href found on the task's page, resolving it against link_base.
+The fragment is dropped since it names a part of a document, not a different one,
+so it returns false for fragment-only hrefs such as "#top", and for hrefs that are not valid urls.
+Links to schemes other than http(s) and the page's own, such as javascript:, mailto:, tel: or data:, are not pages and are skipped too.
+A protocol-relative href such as //cdn.example.com/x.js takes the page's scheme.
+The target is named by its path on the target's host and by its whole url elsewhere, as pages are, so that the
+same page is one node however the links to it are written; the href as written is kept in Href.
+*/
+func new_link(options *ScrapeOptions, task ScrapeTask, link_base string, href string) (PageLink, bool) {
+	written := href;
+	if i := strings.Index(href, "#"); i >= 0 {
+		href = href[:i];
+	}
+	href = strip_query(href, options.normalize);
+	if (href == "") {
+		return PageLink{}, false;
+	}
+	target, err := fix_url(link_base, href);
+	if err != nil {
+		slog.Debug("Rejected: malformed URL", "href", href, "from", string(task.Page), "err", err);
+		return PageLink{}, false;
+	}
+	if scheme := url_scheme(target); scheme != "http" && scheme != "https" && scheme != url_scheme(link_base) {
+		slog.Debug("Skipped " + scheme + ": link", "href", href, "from", string(task.Page));
+		return PageLink{}, false;
+	}
+	return PageLink{From: task.Page, To: page_resource(task.BaseURL, target), URL: target, Href: written, Depth: task.Depth + 1, External: !is_internal(options, target)}, true;
+}
+
+/*
+static_dir serves a built site for -source file like a static web server would:
+a directory is its index.html, or not found rather than a generated listing.
+Unlike http.FileServer it does not redirect /index.html to /, which would add a redirect and a node to every crawl.
+Only a directory named without its trailing slash is redirected, so that the relative links on its index.html resolve inside it.
+*/
+type static_dir struct {
+	root http.Dir;
+}
+
+func (d static_dir) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := &static_response{header: make(http.Header)};
+	d.serve(w, req);
+	return w.response(req), nil;
+}
+
+func (d static_dir) serve(w http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + req.URL.Path);
+	f, err := d.root.Open(name);
+	if err != nil {
+		http.NotFound(w, req);
+		return;
+	}
+	defer f.Close();
+	info, err := f.Stat();
+	if err != nil {
+		http.NotFound(w, req);
+		return;
+	}
+	if (info.IsDir()) {
+		if (name != "/" && !strings.HasSuffix(req.URL.Path, "/")) {
+			http.Redirect(w, req, name + "/", http.StatusMovedPermanently);
+			return;
+		}
+		name = path.Join(name, "index.html");
+		index, err := d.root.Open(name);
+		if err != nil {
+			http.NotFound(w, req);
+			return;
+		}
+		defer index.Close();
+		if info, err = index.Stat(); err != nil || info.IsDir() {
+			http.NotFound(w, req);
+			return;
+		}
+		f = index;
+	}
+	/* ServeContent sets the content type from the extension and answers HEAD and conditional requests */
+	http.ServeContent(w, req, name, info.ModTime(), f);
+}
+
+/* static_response is what static_dir serves, kept to be returned as the response to its request */
+type static_response struct {
+	header http.Header;
+	code int;
+	body bytes.Buffer;
+}
+
+func (w *static_response) Header() http.Header {
+	return w.header;
+}
+
+func (w *static_response) WriteHeader(code int) {
+	if (w.code == 0) {
+		w.code = code;
+	}
+}
+
+func (w *static_response) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK);
+	return w.body.Write(data);
+}
+
+func (w *static_response) response(req *http.Request) *http.Response {
+	w.WriteHeader(http.StatusOK);
+	length := int64(w.body.Len());
+	if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		length = n;
+	}
+	return &http.Response{Status: strconv.Itoa(w.code) + " " + http.StatusText(w.code), StatusCode: w.code, Proto: "HTTP/1.0", ProtoMajor: 1, Header: w.header, Body: io.NopCloser(&w.body), ContentLength: length, Request: req};
+}
+
+/*
+Creates the transport shared by all workers, using the proxy url if given and the environment otherwise.
+insecure turns off TLS certificate verification.
+*/
+func new_transport(proxy string, insecure bool) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone();
+	transport.Proxy = http.ProxyFromEnvironment;
+	if (insecure) {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true};
+	}
+	if (proxy != "") {
+		proxy_url, err := url.Parse(proxy);
+		if err != nil {
+			return nil, err;
+		}
+		if (proxy_url.Scheme == "" || proxy_url.Host == "") {
+			return nil, fmt.Errorf("%s is not an absolute url", proxy);
+		}
+		transport.Proxy = http.ProxyURL(proxy_url);
+	}
+	return transport, nil;
+}
+
+/*
+request_limiter counts every request sent through it, including redirects and robots.txt,
+and refuses those beyond max (0 = no limit), so the rest of the queue is drained without fetching.
+*/
+type request_limiter struct {
+	next http.RoundTripper;
+	max int64;
+	sent atomic.Int64;
+}
+
+func (l *request_limiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (l.max > 0) {
+		n := l.sent.Add(1);
+		if (n == l.max + 1) {
+			slog.Warn("Request limit reached, no further requests are sent", "max", l.max);
+		}
+		if (n > l.max) {
+			return nil, err_request_limit;
+		}
+	}
+	return l.next.RoundTrip(req);
+}
+
+/* Lets http.Client.CloseIdleConnections reach the transport underneath */
+func (l *request_limiter) CloseIdleConnections() {
+	if closer, ok := l.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections();
+	}
+}
+
+/* Returns a child of ctx bounded by the fetcher's timeout, if any */
+func request_context(ctx context.Context, fetcher *Fetcher) (context.Context, context.CancelFunc) {
+	if (fetcher.client.Timeout > 0) {
+		return context.WithTimeout(ctx, fetcher.client.Timeout);
+	}
+	return context.WithCancel(ctx);
+}
+
+/*
+Makes a single request for target with the given method, following redirects through check_redirect.
+The returned cancel func must be called once the response body has been read. Headers in header, which may be nil, are added to the request.
+*/
+func do_request(ctx context.Context, fetcher *Fetcher, method string, target string, header http.Header) (*http.Response, *redirect_chain, context.CancelFunc, error) {
+	req_ctx, cancel := request_context(ctx, fetcher);
+	chain := &redirect_chain{};
+	req_ctx = context.WithValue(req_ctx, redirect_chain_key{}, chain);
+	req, err := new_request(req_ctx, fetcher, method, target);
+	if err != nil {
+		return nil, chain, cancel, err;
+	}
+	for name, values := range header {
+		req.Header[name] = values;
+	}
+	resp, err := fetcher.client.Do(req);
+	return resp, chain, cancel, err;
+}
+
+/* Describes why a request failed without a response */
+func request_error_status(err error) string {
+	if (errors.Is(err, err_redirect_loop)) {
+		return "Rejected due to redirect loop";
+	}
+	if (errors.Is(err, err_too_many_redirects)) {
+		return "Too many redirects";
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "Timeout";
+	}
+	return "HTTP error";
+}
+
+/* Describes why a request failed for the user, telling DNS, connection and TLS failures apart */
+func describe_request_error(err error) string {
+	var dns_err *net.DNSError;
+	var cert_err *tls.CertificateVerificationError;
+	var record_err tls.RecordHeaderError;
+	var ne net.Error;
+	switch {
+	case errors.As(err, &dns_err):
+		return "DNS lookup of " + dns_err.Name + " failed: " + dns_err.Err;
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused";
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset";
+	case errors.As(err, &cert_err):
+		return "TLS certificate error: " + cert_err.Err.Error();
+	case errors.As(err, &record_err):
+		return "TLS handshake failed, the server did not answer with TLS";
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timed out";
+	}
+	return err.Error();
+}
+
+/*
+Saves a page's body under dir as <host>/<path>, creating the directories it needs.
+A path ending in / is saved as its index.html. The query is not part of the name, so pages differing only in it overwrite each other.
+*/
+func save_mirror(dir string, u *url.URL, body []byte) error {
+	name := path.Clean("/" + u.Path);
+	if (strings.HasSuffix(u.Path, "/") || u.Path == "") {
+		name = path.Join(name, "index.html");
+	}
+	target := filepath.Join(dir, canonical_host(u), filepath.FromSlash(name));
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err;
+	}
+	return os.WriteFile(target, body, 0644);
+}
+
+/* counting_reader counts the bytes read through it */
+type counting_reader struct {
+	r io.Reader;
+	n int64;
+}
+
+func (c *counting_reader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p);
+	c.n += int64(n);
+	return n, err;
+}
+
+/* Sleeps for d, returning false early if ctx is cancelled */
+func sleep_ctx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d);
+	defer timer.Stop();
+	select {
+	case <- timer.C:
+		return true;
+	case <- ctx.Done():
+		return false;
+	}
+}
+
+/* Builds a request carrying the headers every worker sends */
+func new_request(ctx context.Context, fetcher *Fetcher, method string, target string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil);
+	if err != nil {
+		return nil, err;
+	}
+	req.Header.Set("User-Agent", fetcher.user_agent);
+	if (host_allowed(fetcher.options, req.URL)) {
+		/* the extra headers may hold credentials too */
+		for name, values := range fetcher.header {
+			req.Header[name] = values;
+		}
+		/* the transport sends req.Host rather than a Host header */
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host;
+			req.Header.Del("Host");
+		}
+		if (fetcher.username != "") {
+			req.SetBasicAuth(fetcher.username, fetcher.password);
+		}
+	}
+	/* setting this ourselves turns off the transport's transparent gzip, see response_body */
+	if (req.Header.Get("Accept-Encoding") == "") {
+		req.Header.Set("Accept-Encoding", "gzip, deflate");
+	}
+	return req, nil;
+}
+
+/*
+Returns the decoded response body according to its Content-Encoding.
+Closing it does not close resp.Body.
+*/
+func response_body(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body);
+	case "deflate":
+		return zlib.NewReader(resp.Body);
+	}
+	return io.NopCloser(resp.Body), nil;
+}
+
+/*
+Returns the base url of an http crawl, with http:// added when it has no scheme, e.g. http://example.com for example.com.
+A base that is still not an http or https url with a host is an error, since every link would be rejected as external.
+*/
+func resolve_base(base string) (string, error) {
+	if (!strings.Contains(base, "://")) {
+		base = "http://" + base;
+	}
+	u, err := url.Parse(base);
+	if err != nil {
+		return "", fmt.Errorf("invalid base url: %v", err);
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("base url must be http or https: %s", base);
+	}
+	if (u.Host == "") {
+		return "", fmt.Errorf("base url has no host: %s", base);
+	}
+	return base, nil;
+}
+
+func fix_url(baseurl string, relurl string) (string, error) {
+	u, err := url.Parse(relurl)
+	if err != nil {
+		return "", err
+	}
+    base, err := url.Parse(baseurl)
+    if err != nil {
+    	return "", err
+    }
+    return base.ResolveReference(u).String(), nil
+}
+
+/*
+
+==================================
+
+Dry run
+
+-dry-run scrapes only the start page, collecting what it finds instead of crawling it,
+and returns each url found with the reason it would or would not be crawled.
+
+*/
+
+/* dry_run_collector keeps the urls found on a page in the order they were found */
+type dry_run_collector struct {
+	urls []string;
+	found map[string]bool;
+	followed map[string]bool; // urls scrape would have queued
+}
+
+func (c *dry_run_collector) add(target string) {
+	if (!c.found[target]) {
+		c.found[target] = true;
+		c.urls = append(c.urls, target);
+	}
+}
+
+func (c *dry_run_collector) add_link(pl PageLink) {
+	if (pl.Report == nil) {
+		c.add(pl.URL);
+	}
+}
+
+func (c *dry_run_collector) add_task(task ScrapeTask) {
+	c.add(task.URL);
+	c.followed[task.URL] = true;
+}
+
+/* DryRunPage is a start page scraped by DryRun, with the status of its worker and every url found on it */
+type DryRunPage struct {
+	URL string;
+	Status string; // "Done", or why the page could not be scraped
+	Redirects []string; // urls the start page redirected through
+	Links []DryRunLink;
+}
+
+/* DryRunLink is a url found on a start page, with the reason it would or would not be crawled */
+type DryRunLink struct {
+	URL string;
+	Verdict string; // e.g. "Would crawl", or "Beyond -max-depth"
+}
+
+/* Scrapes only task's page and returns the urls on it with their verdicts */
+func dry_run_page(ctx context.Context, options *ScrapeOptions, fetcher *Fetcher, task ScrapeTask, max_depth int) DryRunPage {
+	out := &dry_run_collector{found: make(map[string]bool), followed: make(map[string]bool)};
+	report := &PageReport{Page: task.Page};
+	page := DryRunPage{URL: task.URL, Status: scrape(ctx, 0, options, fetcher, task, report, out), Redirects: report.Redirects, Links: []DryRunLink{}};
+	for _, target := range out.urls {
+		if (contains(target, report.Redirects)) {
+			continue;
+		}
+		page.Links = append(page.Links, DryRunLink{URL: target, Verdict: dry_run_verdict(ctx, options, fetcher, target, out.followed[target], max_depth)});
+	}
+	return page;
+}
+
+/* Returns whether a url found on the start page would be crawled, and if not why */
+func dry_run_verdict(ctx context.Context, options *ScrapeOptions, fetcher *Fetcher, target string, followed bool, max_depth int) string {
+	if (!followed) {
+		if reason := skip_reason(options, target); reason != "" {
+			return reason;
+		}
+		return "Recorded as a link, not followed";
+	}
+	external := options.check_external && !is_internal(options, target);
+	if (!within_limit(ScrapeTask{Depth: 1, External: external}, max_depth)) {
+		return "Beyond -max-depth";
+	}
+	u, err := url.Parse(target);
+	if err != nil {
+		return "Rejected: malformed URL";
+	}
+	if reason := fetch_rejection(ctx, options, fetcher, u, external); reason != "" {
+		return reason;
+	}
+	if (external) {
+		return "Would check, external";
+	}
+	return "Would crawl";
+}
+
+/*
+
+==================================
+
+robots.txt support
+
+Rules are fetched once per host and cached for the rest of the crawl.
+A robots.txt that is missing or cannot be fetched allows everything.
+
+*/
+
+/* RobotsRules are the rules from one host's robots.txt that apply to our user agent */
+type RobotsRules struct {
+	allow []string;
+	disallow []string;
+	delay time.Duration; // Crawl-delay, zero if not given
+}
+
+type robots_entry struct {
+	once sync.Once;
+	rules *RobotsRules;
+}
+
+/* RobotsCache maps a scheme://host to its parsed robots.txt */
+type RobotsCache struct {
+	mu sync.Mutex;
+	hosts map[string]*robots_entry;
+}
+
+func new_robots_cache() *RobotsCache {
+	return &RobotsCache{hosts: make(map[string]*robots_entry)};
+}
+
+/* Returns the rules for the host of u, fetching robots.txt on first use */
+func robots_rules_for(ctx context.Context, fetcher *Fetcher, u *url.URL) *RobotsRules {
+	key := u.Scheme + "://" + canonical_host(u);
+
+	fetcher.robots.mu.Lock();
+	entry, ok := fetcher.robots.hosts[key];
+	if (!ok) {
+		entry = &robots_entry{};
+		fetcher.robots.hosts[key] = entry;
+	}
+	fetcher.robots.mu.Unlock();
+
+	entry.once.Do(func() {
+		entry.rules = fetch_robots(ctx, fetcher, key + "/robots.txt");
+	});
+	return entry.rules;
+}
+
+func fetch_robots(ctx context.Context, fetcher *Fetcher, robots_url string) *RobotsRules {
+	ctx, cancel := request_context(ctx, fetcher);
+	defer cancel();
+	req, err := new_request(ctx, fetcher, "GET", robots_url);
+	if err != nil {
+		return &RobotsRules{};
+	}
+	resp, err := fetcher.client.Do(req);
+	if err != nil {
+		return &RobotsRules{};
+	}
+	defer resp.Body.Close();
+	if (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return &RobotsRules{};
+	}
+	body, err := response_body(resp);
+	if err != nil {
+		return &RobotsRules{};
+	}
+	defer body.Close();
+	return parse_robots(bufio.NewScanner(body), fetcher.user_agent);
+}
+
+/*
+Parses robots.txt, keeping the group that names our user agent.
+Falls back to the "*" group when no group names us.
+*/
+func parse_robots(scanner *bufio.Scanner, user_agent string) *RobotsRules {
+	agent := strings.ToLower(user_agent);
+	if i := strings.Index(agent, "/"); i >= 0 {
+		agent = agent[:i];
+	}
+
+	ours := &RobotsRules{};
+	star := &RobotsRules{};
+	found_ours := false;
+
+	var current []*RobotsRules; // groups the lines being read apply to
+	in_agents := false; // true while reading consecutive User-agent lines
+
+	for scanner.Scan() {
+		line := scanner.Text();
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i];
+		}
+		colon := strings.Index(line, ":");
+		if (colon < 0) {
+			continue;
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]));
+		value := strings.TrimSpace(line[colon+1:]);
+
+		if (key == "user-agent") {
+			if (!in_agents) {
+				current = nil;
+			}
+			in_agents = true;
+			name := strings.ToLower(value);
+			if (name == "*") {
+				current = append(current, star);
+			} else if (agent != "" && strings.Contains(agent, name)) {
+				current = append(current, ours);
+				found_ours = true;
+			}
+			continue;
+		}
+		in_agents = false;
+
+		for _, rules := range current {
+			switch key {
+			case "allow":
+				if (value != "") {
+					rules.allow = append(rules.allow, value);
+				}
+			case "disallow":
+				if (value != "") {
+					rules.disallow = append(rules.disallow, value);
+				}
+			case "crawl-delay":
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+					rules.delay = time.Duration(secs * float64(time.Second));
+				}
+			}
+		}
+	}
+
+	if (found_ours) {
+		return ours;
+	}
+	return star;
+}
+
+/* The longest matching rule wins, Allow wins ties */
+func robots_allowed(rules *RobotsRules, path string) bool {
+	allow_len := -1;
+	disallow_len := -1;
+	for _, p := range rules.allow {
+		if (robots_match(p, path) && len(p) > allow_len) {
+			allow_len = len(p);
+		}
+	}
+	for _, p := range rules.disallow {
+		if (robots_match(p, path) && len(p) > disallow_len) {
+			disallow_len = len(p);
+		}
+	}
+	return disallow_len < 0 || allow_len >= disallow_len;
+}
+
+/* Matches a robots.txt path pattern, supporting the * wildcard and the $ end anchor */
+func robots_match(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$");
+	pattern = strings.TrimSuffix(pattern, "$");
+	parts := strings.Split(pattern, "*");
+
+	if (!strings.HasPrefix(path, parts[0])) {
+		return false;
+	}
+	if (len(parts) == 1) {
+		return !anchored || len(path) == len(parts[0]);
+	}
+	pos := len(parts[0]);
+	for _, part := range parts[1:len(parts)-1] {
+		i := strings.Index(path[pos:], part);
+		if (i < 0) {
+			return false;
+		}
+		pos += i + len(part);
+	}
+	last := parts[len(parts)-1];
+	if (anchored) {
+		return strings.HasSuffix(path[pos:], last);
+	}
+	return strings.Contains(path[pos:], last);
+}
+
+/*
+
+==================================
+
+Sitemaps
+
+With a Sitemap the pages it lists are the start pages, so every one of them is fetched and its links checked.
+A sitemap index lists further sitemaps, which are read in turn, and a sitemap may be gzipped, as .xml.gz files are.
+
+*/
+
+/* the most a sitemap may hold uncompressed, from the sitemaps.org protocol */
+const max_sitemap_bytes = 50 << 20;
+
+type sitemap_xml struct {
+	URLs []sitemap_loc `xml:"url"`; // of a <urlset>
+	Sitemaps []sitemap_loc `xml:"sitemap"`; // of a <sitemapindex>
+}
+
+type sitemap_loc struct {
+	Loc string `xml:"loc"`;
+}
+
+/*
+Returns the pages listed by the sitemap at target, relative to target_base, and by any sitemaps it leads to.
+Their hosts are allowed, as those of seeds are, and pages outside the scope prefix or not on http are left out.
+Only the first sitemap has to be read, one that it lists and cannot be read is logged and skipped.
+*/
+func sitemap_start_urls(ctx context.Context, fetcher *Fetcher, target_base string, target string) ([]string, error) {
+	first, err := fix_url(target_base, target);
+	if err != nil {
+		return nil, fmt.Errorf("invalid sitemap url %s: %v", target, err);
+	}
+	options := fetcher.options;
+	if u, err := url.Parse(first); err == nil && !contains(canonical_host(u), options.allowed_hosts) {
+		options.allowed_hosts = append(options.allowed_hosts, canonical_host(u));
+	}
+
+	pages := []string{};
+	queue := []string{first};
+	read := map[string]bool{first: true};
+	for len(queue) > 0 {
+		sitemap_url := queue[0];
+		queue = queue[1:];
+		sitemap, err := fetch_sitemap(ctx, fetcher, sitemap_url);
+		if err != nil {
+			if (sitemap_url == first) {
+				return nil, fmt.Errorf("cannot read sitemap %s: %v", sitemap_url, err);
+			}
+			slog.Warn("Skipped sitemap", "url", sitemap_url, "err", err);
+			continue;
+		}
+		for _, s := range sitemap.Sitemaps {
+			if next, err := fix_url(sitemap_url, strings.TrimSpace(s.Loc)); err == nil && !read[next] {
+				read[next] = true;
+				queue = append(queue, next);
+			}
+		}
+		for _, p := range sitemap.URLs {
+			page, err := fix_url(sitemap_url, strings.TrimSpace(p.Loc));
+			if (err != nil || (url_scheme(page) != "http" && url_scheme(page) != "https" && url_scheme(page) != url_scheme(target_base))) {
+				slog.Debug("Skipped sitemap entry, not an http url", "loc", p.Loc, "sitemap", sitemap_url);
+				continue;
+			}
+			if (options.scope_prefix != "" && !in_scope(options, page)) {
+				slog.Debug("Skipped sitemap entry, outside the scope prefix", "loc", p.Loc, "sitemap", sitemap_url);
+				continue;
+			}
+			if u, err := url.Parse(page); err == nil && !contains(canonical_host(u), options.allowed_hosts) {
+				options.allowed_hosts = append(options.allowed_hosts, canonical_host(u));
+			}
+			pages = append(pages, page);
+		}
+	}
+	if (len(pages) == 0) {
+		return nil, fmt.Errorf("sitemap %s lists no pages to crawl", first);
+	}
+	slog.Info("Read sitemap", "url", first, "sitemaps", len(read), "pages", len(pages));
+	return pages, nil;
+}
+
+/* Fetches and parses one sitemap or sitemap index, gunzipping it when the body is gzipped */
+func fetch_sitemap(ctx context.Context, fetcher *Fetcher, target string) (*sitemap_xml, error) {
+	ctx, cancel := request_context(ctx, fetcher);
+	defer cancel();
+	req, err := new_request(ctx, fetcher, "GET", target);
+	if err != nil {
+		return nil, err;
+	}
+	resp, err := fetcher.client.Do(req);
+	if err != nil {
+		return nil, errors.New(describe_request_error(err));
+	}
+	defer resp.Body.Close();
+	if (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode);
+	}
+	body, err := response_body(resp);
+	if err != nil {
+		return nil, err;
+	}
+	defer body.Close();
+
+	/* a .xml.gz file is gzipped itself rather than sent with a Content-Encoding, so look at its first bytes */
+	buffered := bufio.NewReader(body);
+	var r io.Reader = buffered;
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered);
+		if err != nil {
+			return nil, err;
+		}
+		defer gz.Close();
+		r = gz;
+	}
+
+	sitemap := &sitemap_xml{};
+	decoder := xml.NewDecoder(io.LimitReader(r, max_sitemap_bytes));
+	decoder.CharsetReader = charset.NewReaderLabel;
+	if err := decoder.Decode(sitemap); err != nil {
+		return nil, fmt.Errorf("invalid sitemap: %v", err);
+	}
+	return sitemap, nil;
+}
+
+/*
+
+==================================
+
+Soft 404 detection
+
+Some sites answer a missing page with 200 and an error page. The first time a page on a host is read, a url that
+should not exist is fetched from it, and pages that match what it returned are soft 404s: those with the same body,
+or the same title and nearly the same length, since the error page often names the missing url. When the missing
+url redirects, the pages that redirect to the same place are soft 404s instead, as that is usually the home page.
+
+*/
+
+/* Soft404Cache maps a scheme://host to what it returns for a missing page */
+type Soft404Cache struct {
+	mu sync.Mutex;
+	hosts map[string]*soft_404_entry;
+}
+
+type soft_404_entry struct {
+	once sync.Once;
+	page *soft_404_page; // nil if the host answers missing pages properly
+}
+
+type soft_404_page struct {
+	landed string; // where the missing url redirected to, the rest is unset if it did
+	hash string; // hex SHA-256 of the body, as in PageReport.Hash
+	title string;
+	bytes int64; // length of the body
+}
+
+func new_soft_404_cache() *Soft404Cache {
+	return &Soft404Cache{hosts: make(map[string]*soft_404_entry)};
+}
+
+/* Returns what the host of u returns for a missing page, fetching it on first use */
+func soft_404_for(ctx context.Context, fetcher *Fetcher, u *url.URL) *soft_404_page {
+	key := u.Scheme + "://" + canonical_host(u);
+
+	fetcher.soft_404.mu.Lock();
+	entry, ok := fetcher.soft_404.hosts[key];
+	if (!ok) {
+		entry = &soft_404_entry{};
+		fetcher.soft_404.hosts[key] = entry;
+	}
+	fetcher.soft_404.mu.Unlock();
+
+	entry.once.Do(func() {
+		entry.page = fetch_soft_404(ctx, fetcher, key);
+		if (entry.page != nil) {
+			slog.Info("Host answers missing pages with a 2xx status, checking for soft 404s", "host", key, "redirect", entry.page.landed);
+		}
+	});
+	return entry.page;
+}
+
+func fetch_soft_404(ctx context.Context, fetcher *Fetcher, base string) *soft_404_page {
+	ctx, cancel := request_context(ctx, fetcher);
+	defer cancel();
+	req, err := new_request(ctx, fetcher, "GET", fmt.Sprintf("%s/no-such-page-%016x.html", base, rand.Int63()));
+	if err != nil {
+		return nil;
+	}
+	resp, err := fetcher.client.Do(req);
+	if err != nil {
+		return nil;
+	}
+	defer resp.Body.Close();
+	content_type := resp.Header.Get("Content-Type");
+	if (resp.StatusCode < 200 || resp.StatusCode > 299 || !IsHTML(content_type)) {
+		return nil;
+	}
+	if (resp.Request.URL.String() != req.URL.String()) {
+		return &soft_404_page{landed: resp.Request.URL.String()};
+	}
+	body, err := response_body(resp);
+	if err != nil {
+		return nil;
+	}
+	defer body.Close();
+
+	hasher := sha256.New();
+	counter := &counting_reader{r: io.TeeReader(body, hasher)};
+	if (fetcher.max_bytes > 0) {
+		counter.r = io.LimitReader(counter.r, fetcher.max_bytes);
+	}
+	var page io.Reader = counter;
+	if decoded, err := charset.NewReader(counter, content_type); err == nil {
+		page = decoded;
+	}
+	title := html_title(page);
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return nil;
+	}
+	return &soft_404_page{hash: hex.EncodeToString(hasher.Sum(nil)), title: title, bytes: counter.n};
+}
+
+/* Returns the contents of the page's <title>, as scrape records it */
+func html_title(page io.Reader) string {
+	z := html.NewTokenizer(page);
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return "";
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				if (z.Next() == html.TextToken) {
+					return strings.Join(strings.Fields(z.Token().Data), " ");
+				}
+				return "";
+			}
+		}
+	}
+}
+
+/* Reports whether a page that was read completely, landing at landed with a body of bytes, matches notfound */
+func is_soft_404(notfound *soft_404_page, report *PageReport, landed string, bytes int64) bool {
+	if (notfound == nil) {
+		return false;
+	}
+	if (notfound.landed != "") {
+		return len(report.Redirects) > 0 && landed == notfound.landed;
+	}
+	if (report.Hash == notfound.hash) {
+		return true;
+	}
+	diff := bytes - notfound.bytes;
+	if (diff < 0) {
+		diff = -diff;
+	}
+	return report.Title != "" && report.Title == notfound.title && diff * 20 <= notfound.bytes;
+}
+
+/*
+
+==================================
+
+Per-host rate limiting
+
+Requests to the same host are spaced at least delay apart, so crawling several hosts stays parallel.
+With jitter each gap is a random length between delay and delay + jitter instead.
+
+*/
+
+type HostLimiter struct {
+	delay time.Duration;
+	jitter time.Duration;
+
+	mu sync.Mutex;
+	next map[string]time.Time; // earliest time the next request to each host may start
+	random *rand.Rand; // for the jitter, seeded when the limiter is created
+}
+
+func new_host_limiter(delay time.Duration, jitter time.Duration) *HostLimiter {
+	return &HostLimiter{delay: delay, jitter: jitter, next: make(map[string]time.Time), random: rand.New(rand.NewSource(time.Now().UnixNano()))};
+}
+
+/*
+Blocks until a request to host may start. min_delay overrides the limiter's delay when larger (e.g. Crawl-delay).
+Returns false if ctx was cancelled while waiting.
+*/
+func limiter_wait(ctx context.Context, limiter *HostLimiter, host string, min_delay time.Duration) bool {
+	delay := limiter.delay;
+	if (min_delay > delay) {
+		delay = min_delay;
+	}
+	if (delay <= 0 && limiter.jitter <= 0) {
+		return true;
+	}
+
+	limiter.mu.Lock();
+	if (limiter.jitter > 0) {
+		delay += time.Duration(limiter.random.Int63n(int64(limiter.jitter) + 1));
+	}
+	now := time.Now();
+	start := limiter.next[host];
+	if (start.Before(now)) {
+		start = now;
+	}
+	limiter.next[host] = start.Add(delay);
+	limiter.mu.Unlock();
+
+	return sleep_ctx(ctx, time.Until(start));
+}
+
+/*
+
+==================================
+
+Per-host connection limit
+
+At most limit requests to the same host are in flight at once, each holding a slot from when it is sent
+until its body has been read, so the workers spread over the other hosts instead.
+
+*/
+
+type HostConnections struct {
+	limit int; // 0 = no limit
+
+	mu sync.Mutex;
+	slots map[string]chan struct{}; // a semaphore per host, with limit slots
+}
+
+func new_host_connections(limit int) *HostConnections {
+	return &HostConnections{limit: limit, slots: make(map[string]chan struct{})};
+}
+
+/*
+Blocks until a request to host may be sent, returning the func that frees its slot, which may be called more than once.
+Returns false if ctx was cancelled while waiting.
+*/
+func connections_acquire(ctx context.Context, connections *HostConnections, host string) (func(), bool) {
+	if (connections.limit <= 0) {
+		return func() {}, true;
+	}
+	connections.mu.Lock();
+	slot, ok := connections.slots[host];
+	if (!ok) {
+		slot = make(chan struct{}, connections.limit);
+		connections.slots[host] = slot;
+	}
+	connections.mu.Unlock();
+
+	select {
+	case slot <- struct{}{}:
+	case <-ctx.Done():
+		return func() {}, false;
+	}
+	var once sync.Once;
+	return func() { once.Do(func() { <-slot }) }, true;
+}
+
+/* A page is broken if fetching it failed, returned a 4xx/5xx status or is a soft 404 */
+func IsBroken(report *PageReport) bool {
+	return report.FetchError || report.Code >= 400 || report.Soft404;
+}
+
+/*
+
+==================================
+
+Crawl state
+
+The pages visited and still pending, keyed by normalized url, so that the caller can save
+them in a checkpoint and hand them back to Crawl to continue an interrupted crawl.
+
+*/
+
+/* CrawlState is the part of unbounded_buffer's state that is saved in checkpoints */
+type CrawlState struct {
+	mu sync.Mutex;
+	visited map[string]bool; // pages that have been scraped
+	pending map[string]ScrapeTask; // pages queued or in flight
+}
+
+func NewCrawlState() *CrawlState {
+	return &CrawlState{visited: make(map[string]bool), pending: make(map[string]ScrapeTask)};
+}
+
+/* Returns the visited pages and a copy of the pending tasks, taken together so they are consistent */
+func (s *CrawlState) Snapshot() ([]string, map[string]ScrapeTask) {
+	s.mu.Lock();
+	defer s.mu.Unlock();
+	visited := make([]string, 0, len(s.visited));
+	for key := range s.visited {
+		visited = append(visited, key);
+	}
+	pending := make(map[string]ScrapeTask, len(s.pending));
+	for key, t := range s.pending {
+		pending[key] = t;
+	}
+	return visited, pending;
+}
+
+/* Adds the pages of a saved crawl, which is then resumed by passing the state to Crawl, which sets the BaseURL of the pending tasks */
+func (s *CrawlState) Restore(visited []string, pending map[string]ScrapeTask) {
+	s.mu.Lock();
+	defer s.mu.Unlock();
+	for _, key := range visited {
+		s.visited[key] = true;
+	}
+	for key, t := range pending {
+		s.pending[key] = t;
+	}
+}
+
+/* Names the pending tasks of a resumed crawl against base, whatever BaseURL they were saved or restored with */
+func (s *CrawlState) rebase(base string) {
+	s.mu.Lock();
+	defer s.mu.Unlock();
+	for key, t := range s.pending {
+		t.BaseURL = base;
+		s.pending[key] = t;
+	}
+}
+
+func (s *CrawlState) queued(key string, task ScrapeTask) {
+	s.mu.Lock();
+	s.pending[key] = task;
+	s.mu.Unlock();
+}
+
+/* Marks the page as visited, or keeps it pending when the scrape was not complete */
+func (s *CrawlState) finished(key string, complete bool) {
+	if (!complete) {
+		return;
+	}
+	s.mu.Lock();
+	delete(s.pending, key);
+	s.visited[key] = true;
+	s.mu.Unlock();
+}
+
@@ -0,0 +1,708 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* slice_collector keeps what scrape finds, so a test can look at it */
+type slice_collector struct {
+	links []PageLink;
+	tasks []ScrapeTask;
+}
+
+func (c *slice_collector) add_link(pl PageLink) { c.links = append(c.links, pl) }
+func (c *slice_collector) add_task(task ScrapeTask) { c.tasks = append(c.tasks, task) }
+
+/* fixture_page is a response of a fixture site, html unless it has a content type */
+type fixture_page struct {
+	content_type string;
+	body string;
+}
+
+/* Starts a server answering each path with its fixture page, and 404 for the rest */
+func fixture_site(t *testing.T, pages map[string]fixture_page) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path];
+		if (!ok) {
+			http.NotFound(w, r);
+			return;
+		}
+		content_type := page.content_type;
+		if (content_type == "") {
+			content_type = "text/html; charset=utf-8";
+		}
+		w.Header().Set("Content-Type", content_type);
+		w.Write([]byte(page.body));
+	}));
+	t.Cleanup(srv.Close);
+	return srv;
+}
+
+/* Returns the Config of a small crawl of srv starting at /index.html, without robots.txt */
+func fixture_config(srv *httptest.Server) Config {
+	return Config{BaseURL: srv.URL, StartPage: "/index.html", Workers: 1, MaxDepth: 1, IgnoreRobots: true};
+}
+
+/* Scrapes one url with the options and fetcher cfg gives, returning the worker's status, the report and what was found */
+func scrape_url(t *testing.T, cfg Config, target string) (string, *PageReport, *slice_collector) {
+	t.Helper();
+	c, err := new_crawl(context.Background(), cfg);
+	if err != nil {
+		t.Fatalf("new_crawl: %v", err);
+	}
+	task := c.starts[0];
+	if (target != "") {
+		task = seed_task(task.BaseURL, target);
+	}
+	report := &PageReport{Page: task.Page, Depth: task.Depth};
+	out := &slice_collector{};
+	status := scrape(context.Background(), 0, c.options, c.fetcher, task, report, out);
+	return status, report, out;
+}
+
+/* Returns the kind of each link found, by url */
+func link_kinds_by_url(links []PageLink) map[string]string {
+	kinds := make(map[string]string);
+	for _, pl := range links {
+		kinds[pl.URL] = pl.Kind;
+	}
+	return kinds;
+}
+
+func TestScrapeExtractsLinks(t *testing.T) {
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<html><head><title>Home</title><link rel="stylesheet" href="/style.css"><script src="/app.js"></script></head>
+			<body><a href="/a.html">First page</a> <img src="/logo.png"> <a href="b.html#top">Second</a></body></html>`},
+	});
+	status, report, out := scrape_url(t, fixture_config(srv), "");
+	if (status != "Done") {
+		t.Fatalf("status = %q, want Done", status);
+	}
+	if (report.Title != "Home" || report.Code != 200) {
+		t.Errorf("report title %q code %d, want Home 200", report.Title, report.Code);
+	}
+
+	want := map[string]string{
+		srv.URL + "/style.css": "stylesheet",
+		srv.URL + "/app.js": "script",
+		srv.URL + "/a.html": "anchor",
+		srv.URL + "/logo.png": "image",
+		srv.URL + "/b.html": "anchor",
+	};
+	got := link_kinds_by_url(out.links);
+	if (len(got) != len(want)) {
+		t.Errorf("found %d links %v, want %d", len(got), got, len(want));
+	}
+	for u, kind := range want {
+		if (got[u] != kind) {
+			t.Errorf("link %s has kind %q, want %q", u, got[u], kind);
+		}
+	}
+	for _, pl := range out.links {
+		if (pl.URL == srv.URL + "/a.html" && pl.Text != "First page") {
+			t.Errorf("anchor text = %q, want %q", pl.Text, "First page");
+		}
+		if (pl.Depth != 1 || pl.External) {
+			t.Errorf("link %s has depth %d external %v, want 1 false", pl.URL, pl.Depth, pl.External);
+		}
+	}
+
+	/* only the anchors are crawled, stylesheets, scripts and images are just recorded */
+	queued := []string{};
+	for _, task := range out.tasks {
+		queued = append(queued, task.URL);
+	}
+	if (strings.Join(queued, " ") != srv.URL + "/a.html " + srv.URL + "/b.html") {
+		t.Errorf("queued %v, want the two anchors", queued);
+	}
+}
+
+func TestScrapeRejectsContentType(t *testing.T) {
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {content_type: "application/json", body: `{"href": "/a.html"}`},
+	});
+	status, report, out := scrape_url(t, fixture_config(srv), "");
+	if (status != "Rejected due to content-type=application/json") {
+		t.Errorf("status = %q", status);
+	}
+	if (report.Code != 200 || len(out.links) != 0 || len(out.tasks) != 0) {
+		t.Errorf("code %d, %d links, %d tasks, want 200 and nothing found", report.Code, len(out.links), len(out.tasks));
+	}
+}
+
+func TestScrapeHostFiltering(t *testing.T) {
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<a href="/local.html">local</a> <a href="http://other.example/page.html">other</a>`},
+	});
+
+	/* a link to another host may be queued, but is never fetched */
+	_, _, out := scrape_url(t, fixture_config(srv), "");
+	if (len(out.links) != 2 || len(out.tasks) != 2) {
+		t.Errorf("found %d links and %d tasks, want both of each", len(out.links), len(out.tasks));
+	}
+	for _, pl := range out.links {
+		if want := strings.HasPrefix(pl.URL, "http://other.example/"); pl.External != want {
+			t.Errorf("link %s external = %v, want %v", pl.URL, pl.External, want);
+		}
+	}
+	status, report, out := scrape_url(t, fixture_config(srv), "http://other.example/page.html");
+	if (status != "Rejected due to hostname=other.example (not an allowed host)") {
+		t.Errorf("status = %q", status);
+	}
+	if (report.Code != 0 || len(out.links) != 0) {
+		t.Errorf("a page on another host was fetched: code %d, %d links", report.Code, len(out.links));
+	}
+
+	/* with RecordExternal it is not even queued */
+	cfg := fixture_config(srv);
+	cfg.RecordExternal = true;
+	_, _, out = scrape_url(t, cfg, "");
+	if (len(out.tasks) != 1 || out.tasks[0].URL != srv.URL + "/local.html") {
+		t.Errorf("queued %v, want only the local page", out.tasks);
+	}
+	if (len(out.links) != 2) {
+		t.Errorf("recorded %d links, want both", len(out.links));
+	}
+}
+
+/* Runs a whole crawl and returns everything sent on its channel, failing if it does not end within a few seconds */
+func crawl_all(t *testing.T, cfg Config) []PageLink {
+	t.Helper();
+	results, err := Crawl(context.Background(), cfg);
+	if err != nil {
+		t.Fatalf("Crawl: %v", err);
+	}
+	found := []PageLink{};
+	timeout := time.After(10 * time.Second);
+	for {
+		select {
+		case pl, ok := <- results:
+			if (!ok) {
+				return found;
+			}
+			found = append(found, pl);
+		case <- timeout:
+			t.Fatalf("the crawl did not finish, %d results so far", len(found));
+		}
+	}
+}
+
+/* Returns the urls of the pages a crawl fetched, sorted */
+func fetched_urls(found []PageLink) []string {
+	urls := []string{};
+	for _, pl := range found {
+		if (pl.Report != nil && pl.Report.Code != 0) {
+			urls = append(urls, pl.Report.URL);
+		}
+	}
+	sort.Strings(urls);
+	return urls;
+}
+
+/* Fails unless the number of goroutines drops back to before, giving closed connections a moment to wind down */
+func expect_no_leftover_goroutines(t *testing.T, before int) {
+	t.Helper();
+	deadline := time.Now().Add(2 * time.Second);
+	for (runtime.NumGoroutine() > before) {
+		if (time.Now().After(deadline)) {
+			buf := make([]byte, 1 << 16);
+			t.Fatalf("%d goroutines left over from the crawl, %d before:\n%s", runtime.NumGoroutine() - before, before, buf[:runtime.Stack(buf, true)]);
+		}
+		time.Sleep(10 * time.Millisecond);
+	}
+}
+
+/* A small site where every page links back to the start */
+var linked_site = map[string]fixture_page{
+	"/index.html": {body: `<a href="/a.html">a</a> <a href="/b.html">b</a>`},
+	"/a.html": {body: `<a href="/index.html">home</a> <a href="/b.html">b</a>`},
+	"/b.html": {body: `<a href="/index.html">home</a> <a href="/c.html">c</a>`},
+	"/c.html": {body: `<a href="/index.html">home</a>`},
+};
+
+func TestConcurrentCrawlsAreIsolated(t *testing.T) {
+	first := fixture_site(t, linked_site);
+	second := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<a href="/x.html">x</a>`},
+		"/x.html": {body: `<a href="/index.html">home</a>`},
+	});
+	before := runtime.NumGoroutine();
+
+	for round := 0; round < 3; round++ {
+		var wg sync.WaitGroup;
+		var first_found, second_found []PageLink;
+		wg.Add(2);
+		go func() {
+			defer wg.Done();
+			cfg := fixture_config(first);
+			cfg.Workers, cfg.MaxDepth = 4, -1;
+			first_found = crawl_all(t, cfg);
+		}();
+		go func() {
+			defer wg.Done();
+			cfg := fixture_config(second);
+			cfg.Workers, cfg.MaxDepth = 4, -1;
+			second_found = crawl_all(t, cfg);
+		}();
+		wg.Wait();
+
+		if got, want := strings.Join(fetched_urls(first_found), " "), first.URL + "/a.html " + first.URL + "/b.html " + first.URL + "/c.html " + first.URL + "/index.html"; got != want {
+			t.Errorf("first crawl fetched %s, want %s", got, want);
+		}
+		if got, want := strings.Join(fetched_urls(second_found), " "), second.URL + "/index.html " + second.URL + "/x.html"; got != want {
+			t.Errorf("second crawl fetched %s, want %s", got, want);
+		}
+	}
+	expect_no_leftover_goroutines(t, before);
+}
+
+func TestMaxDepthFetchesPagesWithinHops(t *testing.T) {
+	/* index -> a -> b -> c, and index also links to c through an image, which is never fetched */
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<a href="/a.html">a</a> <img src="/c.html">`},
+		"/a.html": {body: `<a href="/b.html">b</a>`},
+		"/b.html": {body: `<a href="/c.html">c</a>`},
+		"/c.html": {body: `no links`},
+	});
+	for _, tc := range []struct {
+		max_depth int;
+		fetched []string;
+	}{
+		{0, []string{"/index.html"}},
+		{1, []string{"/a.html", "/index.html"}},
+		{2, []string{"/a.html", "/b.html", "/index.html"}},
+		{-1, []string{"/a.html", "/b.html", "/c.html", "/index.html"}},
+	} {
+		cfg := fixture_config(srv);
+		cfg.MaxDepth = tc.max_depth;
+		want := []string{};
+		for _, p := range tc.fetched {
+			want = append(want, srv.URL + p);
+		}
+		if got := fetched_urls(crawl_all(t, cfg)); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("max depth %d fetched %v, want %v", tc.max_depth, got, want);
+		}
+	}
+}
+
+func TestCyclicSiteFinishes(t *testing.T) {
+	/* every page links to itself, to the start and around a cycle, so the crawl only ends through deduplication */
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<a href="/index.html">self</a> <a href="/a.html">a</a>`},
+		"/a.html": {body: `<a href="/a.html">self</a> <a href="/b.html">b</a> <a href="/index.html">home</a>`},
+		"/b.html": {body: `<a href="/c.html">c</a> <a href="/a.html?">a again</a> <a href="/index.html#top">home</a>`},
+		"/c.html": {body: `<a href="/a.html">a</a> <a href="/b.html">b</a> <a href="/c.html">self</a>`},
+	});
+	for _, order := range []string{"bfs", "dfs"} {
+		cfg := fixture_config(srv);
+		cfg.Workers, cfg.MaxDepth, cfg.Order = 3, -1, order;
+		found := crawl_all(t, cfg);
+
+		want := srv.URL + "/a.html " + srv.URL + "/b.html " + srv.URL + "/c.html " + srv.URL + "/index.html";
+		if got := strings.Join(fetched_urls(found), " "); got != want {
+			t.Errorf("%s crawl fetched %s, want each page once: %s", order, got, want);
+		}
+		links := 0;
+		for _, pl := range found {
+			if (pl.Report == nil) {
+				links += 1;
+			}
+		}
+		if (links != 11) {
+			t.Errorf("%s crawl sent %d links, want all 11", order, links);
+		}
+	}
+}
+
+/* Returns a site of n pages /0.html to /<n-1>.html, each linking to the next per_page pages around a ring */
+func ring_site(n int, per_page int) map[string]fixture_page {
+	pages := make(map[string]fixture_page);
+	for i := 0; i < n; i++ {
+		var body strings.Builder;
+		for j := 1; j <= per_page; j++ {
+			fmt.Fprintf(&body, `<a href="/%d.html">%d</a> `, (i + j) % n, j);
+		}
+		pages[fmt.Sprintf("/%d.html", i)] = fixture_page{body: body.String()};
+	}
+	return pages;
+}
+
+/* Counts the links and the fetched pages among a crawl's results */
+func count_results(found []PageLink) (links int, pages int) {
+	for _, pl := range found {
+		if (pl.Report == nil) {
+			links += 1;
+		} else if (pl.Report.Code == 200) {
+			pages += 1;
+		}
+	}
+	return links, pages;
+}
+
+func TestManyWorkersFinishWithEveryLink(t *testing.T) {
+	const n, per_page = 300, 6;
+	srv := fixture_site(t, ring_site(n, per_page));
+	for _, submit_buffer := range []int{0, 1000} {
+		cfg := fixture_config(srv);
+		cfg.StartPage, cfg.Workers, cfg.MaxDepth, cfg.SubmitBuffer = "/0.html", 200, -1, submit_buffer;
+		if links, pages := count_results(crawl_all(t, cfg)); pages != n || links != n * per_page {
+			t.Errorf("submit buffer %d: fetched %d pages and sent %d links, want %d and %d", submit_buffer, pages, links, n, n * per_page);
+		}
+	}
+}
+
+func TestSlowConsumerWithTinyBuffers(t *testing.T) {
+	const n, per_page = 60, 4;
+	srv := fixture_site(t, ring_site(n, per_page));
+	for _, buffer := range []int{0, 1} {
+		cfg := fixture_config(srv);
+		cfg.StartPage, cfg.Workers, cfg.MaxDepth = "/0.html", 8, -1;
+		cfg.SubmitBuffer, cfg.ResultsBuffer = buffer, buffer;
+		results, err := Crawl(context.Background(), cfg);
+		if err != nil {
+			t.Fatalf("Crawl: %v", err);
+		}
+
+		/* the workers block on full channels while the consumer sleeps, which must slow the crawl down but not stall it */
+		found := []PageLink{};
+		timeout := time.After(20 * time.Second);
+		for done := false; !done; {
+			select {
+			case pl, ok := <- results:
+				if (!ok) {
+					done = true;
+					break;
+				}
+				found = append(found, pl);
+				time.Sleep(time.Millisecond);
+			case <- timeout:
+				t.Fatalf("buffers of %d: the crawl stalled after %d results", buffer, len(found));
+			}
+		}
+		if links, pages := count_results(found); pages != n || links != n * per_page {
+			t.Errorf("buffers of %d: fetched %d pages and sent %d links, want %d and %d", buffer, pages, links, n, n * per_page);
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	for _, tc := range []struct {
+		url string;
+		host string;
+	}{
+		{"http://example.com/", "example.com"},
+		{"http://Example.COM:80/", "example.com"},
+		{"https://example.com:443/a", "example.com"},
+		{"http://example.com:443/", "example.com:443"},
+		{"https://example.com:80/", "example.com:80"},
+		{"http://example.com:8080/", "example.com:8080"},
+		{"http://example.com:/", "example.com"},
+		{"http://[::1]:8080/", "[::1]:8080"},
+		{"http://[::1]:80/", "[::1]"},
+		{"http://[::1]/", "[::1]"},
+		{"http://[FE80::1]/", "[fe80::1]"},
+	} {
+		u, err := url.Parse(tc.url);
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err);
+		}
+		if got := canonical_host(u); got != tc.host {
+			t.Errorf("canonical_host(%s) = %q, want %q", tc.url, got, tc.host);
+		}
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	options := &ScrapeOptions{allowed_hosts: []string{"example.com", "[::1]:8080"}};
+	subdomains := &ScrapeOptions{allowed_hosts: []string{"example.com"}, include_subdomains: true};
+	for _, tc := range []struct {
+		options *ScrapeOptions;
+		url string;
+		allowed bool;
+	}{
+		{options, "http://example.com/", true},
+		{options, "http://host@example.com:80/page", true},
+		{options, "https://EXAMPLE.com:443/", true},
+		{options, "http://example.com:8080/", false},
+		{options, "http://www.example.com/", false},
+		{options, "http://[::1]:8080/", true},
+		{options, "http://[::1]/", false},
+		{options, "http://[::1]:8081/", false},
+		{subdomains, "http://www.example.com/", true},
+		{subdomains, "http://a.b.example.com/", true},
+		{subdomains, "http://badexample.com/", false},
+	} {
+		u, err := url.Parse(tc.url);
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err);
+		}
+		if got := host_allowed(tc.options, u); got != tc.allowed {
+			t.Errorf("host_allowed(%s) = %v, want %v", tc.url, got, tc.allowed);
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	plain := &NormalizeOptions{};
+	sorted := &NormalizeOptions{sort_query: true};
+	stripped := &NormalizeOptions{ignore_params: map[string]bool{"utm_source": true}};
+	for _, tc := range []struct {
+		options *NormalizeOptions;
+		url string;
+		normalized string;
+	}{
+		{plain, "http://host:80/", "http://host/"},
+		{plain, "http://host/", "http://host/"},
+		{plain, "http://host", "http://host/"},
+		{plain, "HTTP://Host/Page", "http://host/Page"},
+		{plain, "https://host:443/a/", "https://host/a"},
+		{plain, "http://host:8080/a#top", "http://host:8080/a"},
+		{plain, "http://host/a?", "http://host/a"},
+		{plain, "http://[::1]:8080/a", "http://[::1]:8080/a"},
+		{plain, "http://[::1]:80/a", "http://[::1]/a"},
+		{plain, "http://host/?b=2&a=1", "http://host/?b=2&a=1"},
+		{sorted, "http://host/?b=2&a=1", "http://host/?a=1&b=2"},
+		{stripped, "http://host/a?utm_source=x&id=3", "http://host/a?id=3"},
+		{stripped, "http://host/a?utm_source=x", "http://host/a"},
+	} {
+		if got := normalize_url(tc.url, tc.options); got != tc.normalized {
+			t.Errorf("normalize_url(%s) = %q, want %q", tc.url, got, tc.normalized);
+		}
+	}
+}
+
+func TestFollowedAssetsCountTowardsDepth(t *testing.T) {
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<link rel="stylesheet" href="/style.css"> <iframe src="/frame.html"></iframe> <img src="/logo.png">`},
+		"/style.css": {content_type: "text/css", body: `@import "/more.css"; body { background: url(/bg.png) }`},
+		"/more.css": {content_type: "text/css", body: `p { color: red }`},
+		"/frame.html": {body: `<a href="/inner.html">inner</a>`},
+		"/inner.html": {body: `no links`},
+		"/logo.png": {content_type: "image/png", body: "png"},
+		"/bg.png": {content_type: "image/png", body: "png"},
+	});
+	for _, tc := range []struct {
+		max_depth int;
+		fetched map[string]int; // path to the depth it was fetched at
+	}{
+		{0, map[string]int{"/index.html": 0}},
+		{1, map[string]int{"/index.html": 0, "/style.css": 1, "/frame.html": 1, "/logo.png": 1}},
+		{2, map[string]int{"/index.html": 0, "/style.css": 1, "/frame.html": 1, "/logo.png": 1, "/more.css": 2, "/bg.png": 2, "/inner.html": 2}},
+	} {
+		cfg := fixture_config(srv);
+		cfg.MaxDepth, cfg.CrawlCSS, cfg.FollowIframes, cfg.HeadAssets, cfg.SkipExtensions = tc.max_depth, true, true, true, []string{"png"};
+		got := make(map[string]int);
+		for _, pl := range crawl_all(t, cfg) {
+			if (pl.Report != nil && pl.Report.Code != 0) {
+				got[strings.TrimPrefix(pl.Report.URL, srv.URL)] = pl.Report.Depth;
+			}
+		}
+		if (len(got) != len(tc.fetched)) {
+			t.Errorf("max depth %d fetched %v, want %v", tc.max_depth, got, tc.fetched);
+			continue;
+		}
+		for p, depth := range tc.fetched {
+			if d, ok := got[p]; !ok || d != depth {
+				t.Errorf("max depth %d: %s fetched %v at depth %d, want depth %d", tc.max_depth, p, ok, d, depth);
+			}
+		}
+	}
+}
+
+func TestLinksAreNamedByTheirPath(t *testing.T) {
+	pages := map[string]fixture_page{};
+	srv := fixture_site(t, pages);
+	pages["/docs/index.html"] = fixture_page{body: `<a href="a.html">docs a</a> <a href="../a.html">root a</a> <a href="` + srv.URL + `/docs/a.html#top">docs a again</a> <a href="http://other.example/a.html">other</a>`};
+
+	_, _, out := scrape_url(t, fixture_config(srv), srv.URL + "/docs/index.html");
+	want := []Resource{"/docs/a.html", "/a.html", "/docs/a.html", "http://other.example/a.html"};
+	if (len(out.links) != len(want)) {
+		t.Fatalf("found %d links, want %d", len(out.links), len(want));
+	}
+	for i, pl := range out.links {
+		if (pl.From != "/docs/index.html" || pl.To != want[i]) {
+			t.Errorf("link %q is %s -> %s, want /docs/index.html -> %s", pl.Href, pl.From, pl.To, want[i]);
+		}
+	}
+	if (out.links[0].Href != "a.html") {
+		t.Errorf("href = %q, want it as written", out.links[0].Href);
+	}
+}
+
+func TestAcceptIsSentOnlyForPages(t *testing.T) {
+	pages := map[string]fixture_page{
+		"/index.html": {body: `<link rel="stylesheet" href="/style.css"> <script src="/app.js"></script> <iframe src="/frame.html"></iframe> <a href="/a.html">a</a> <img src="/logo.png">`},
+		"/style.css": {content_type: "text/css", body: `body { background: url(/bg.png) }`},
+		"/app.js": {content_type: "application/javascript", body: `var next = "/next.html";`},
+		"/frame.html": {body: `no links`},
+		"/a.html": {body: `no links`},
+		"/logo.png": {content_type: "image/png", body: "png"},
+	};
+	var mu sync.Mutex;
+	accepts := make(map[string]string);
+	site := fixture_site(t, pages);
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock();
+		accepts[r.URL.Path] = r.Header.Get("Accept");
+		mu.Unlock();
+		site.Config.Handler.ServeHTTP(w, r);
+	}));
+	t.Cleanup(srv.Close);
+
+	cfg := fixture_config(srv);
+	cfg.Accept, cfg.CrawlCSS, cfg.ScanJS, cfg.FollowIframes, cfg.HeadAssets, cfg.SkipExtensions = "text/html", true, true, true, true, []string{"png"};
+	crawl_all(t, cfg);
+	want := map[string]string{"/index.html": "text/html", "/a.html": "text/html", "/frame.html": "text/html", "/style.css": "", "/app.js": "", "/logo.png": ""};
+	for p, accept := range want {
+		if got, ok := accepts[p]; !ok || got != accept {
+			t.Errorf("%s fetched %v with Accept %q, want %q", p, ok, got, accept);
+		}
+	}
+}
+
+func TestNewRequestHonoursHeaders(t *testing.T) {
+	cfg := Config{BaseURL: "http://127.0.0.1:8080", StartPage: "/", Workers: 1, IgnoreRobots: true, Header: http.Header{"Host": {"example.com"}, "Accept-Encoding": {"identity"}}};
+	c, err := new_crawl(context.Background(), cfg);
+	if err != nil {
+		t.Fatalf("new_crawl: %v", err);
+	}
+	req, err := new_request(context.Background(), c.fetcher, "GET", "http://127.0.0.1:8080/index.html");
+	if err != nil {
+		t.Fatalf("new_request: %v", err);
+	}
+	if (req.Host != "example.com" || req.Header.Get("Host") != "") {
+		t.Errorf("host = %q with header %q, want example.com and no header", req.Host, req.Header.Get("Host"));
+	}
+	if got := req.Header.Get("Accept-Encoding"); got != "identity" {
+		t.Errorf("Accept-Encoding = %q, want identity", got);
+	}
+
+	/* other hosts get neither, but still the default encodings */
+	req, err = new_request(context.Background(), c.fetcher, "GET", "http://other.example/");
+	if err != nil {
+		t.Fatalf("new_request: %v", err);
+	}
+	if (req.Host != "other.example" || req.Header.Get("Accept-Encoding") != "gzip, deflate") {
+		t.Errorf("other host got host %q and Accept-Encoding %q", req.Host, req.Header.Get("Accept-Encoding"));
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch (r.URL.Path) {
+		case "/index.html":
+			http.Redirect(w, r, "/moved.html", http.StatusMovedPermanently);
+		case "/moved.html":
+			http.Redirect(w, r, "/final.html", http.StatusFound);
+		default:
+			w.Header().Set("Content-Type", "text/html");
+			w.Write([]byte("no links"));
+		}
+	}));
+	t.Cleanup(srv.Close);
+	for _, tc := range []struct {
+		max_redirects int;
+		no_redirects bool;
+		status string;
+	}{
+		{0, true, "Too many redirects"},
+		{1, false, "Too many redirects"},
+		{2, false, "Done"},
+		{0, false, "Done"},
+	} {
+		cfg := fixture_config(srv);
+		cfg.MaxRedirects, cfg.NoRedirects = tc.max_redirects, tc.no_redirects;
+		if status, _, _ := scrape_url(t, cfg, ""); status != tc.status {
+			t.Errorf("max redirects %d, no redirects %v: status %q, want %q", tc.max_redirects, tc.no_redirects, status, tc.status);
+		}
+	}
+	if err := (Config{BaseURL: srv.URL, Workers: 1, MaxRedirects: -1}).Validate(); err == nil {
+		t.Errorf("max redirects -1 is valid, want an error");
+	}
+}
+
+func TestResumedTasksAreNamedAgainstTheResolvedBase(t *testing.T) {
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<a href="/a.html">a</a>`},
+		"/a.html": {body: `<a href="/b.html">b</a>`},
+		"/b.html": {body: `b`},
+	});
+	/* as a checkpoint given -target without a scheme restores it */
+	host := strings.TrimPrefix(srv.URL, "http://");
+	state := NewCrawlState();
+	state.Restore([]string{srv.URL + "/index.html"}, map[string]ScrapeTask{srv.URL + "/a.html": {BaseURL: host, Page: "/a.html", URL: srv.URL + "/a.html", Depth: 1, Document: true}});
+
+	cfg := fixture_config(srv);
+	cfg.BaseURL = host;
+	cfg.MaxDepth = 2;
+	cfg.State = state;
+	for _, pl := range crawl_all(t, cfg) {
+		if (pl.Report == nil && (pl.From != "/a.html" || pl.To != "/b.html")) {
+			t.Errorf("link %s -> %s, want /a.html -> /b.html", pl.From, pl.To);
+		}
+	}
+}
+
+func TestDryRunReturnsVerdicts(t *testing.T) {
+	srv := fixture_site(t, map[string]fixture_page{
+		"/index.html": {body: `<a href="/a.html">a</a> <a href="http://other.example/">other</a>`},
+	});
+	pages, err := DryRun(context.Background(), fixture_config(srv));
+	if err != nil {
+		t.Fatalf("DryRun: %v", err);
+	}
+	if (len(pages) != 1 || pages[0].Status != "Done") {
+		t.Fatalf("pages = %+v, want the start page done", pages);
+	}
+	want := []DryRunLink{{URL: srv.URL + "/a.html", Verdict: "Would crawl"}, {URL: "http://other.example/"}};
+	if (len(pages[0].Links) != len(want)) {
+		t.Fatalf("links = %+v, want %d", pages[0].Links, len(want));
+	}
+	if (pages[0].Links[0] != want[0] || pages[0].Links[1].URL != want[1].URL || pages[0].Links[1].Verdict == "Would crawl") {
+		t.Errorf("links = %+v, want %s crawled and %s not", pages[0].Links, want[0].URL, want[1].URL);
+	}
+}
+
+func TestFileSourceServesIndexWithoutRedirecting(t *testing.T) {
+	dir := t.TempDir();
+	files := map[string]string{
+		"index.html": `<a href="/index.html">home</a> <a href="docs">docs</a> <a href="missing.html">missing</a>`,
+		"docs/index.html": `<a href="a.html">a</a>`,
+		"docs/a.html": `a`,
+	};
+	for name, body := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755);
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err);
+		}
+	}
+
+	cfg := Config{BaseURL: dir, Source: "file", StartPage: "/index.html", Workers: 1, MaxDepth: 3};
+	codes := make(map[string]int);
+	for _, pl := range crawl_all(t, cfg) {
+		if (pl.Report == nil) {
+			continue;
+		}
+		codes[pl.Report.URL] = pl.Report.Code;
+		/* only a directory named without its slash is redirected, as a web server would */
+		if want := pl.Report.URL == "file:///docs"; want != (len(pl.Report.Redirects) > 0) {
+			t.Errorf("%s redirected through %v", pl.Report.URL, pl.Report.Redirects);
+		}
+	}
+	want := map[string]int{"file:///index.html": 200, "file:///docs": 200, "file:///docs/a.html": 200, "file:///missing.html": 404};
+	if (fmt.Sprint(codes) != fmt.Sprint(want)) {
+		t.Errorf("fetched %v, want %v", codes, want);
+	}
+}
@@ -0,0 +1,7 @@
+module github.com/kieranvs/web-crawler
+
+go 1.26.0
+
+require golang.org/x/net v0.59.0
+
+require golang.org/x/text v0.42.0 // indirect
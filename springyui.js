@@ -141,9 +141,9 @@ jQuery.fn.springy = function(params) {
 	};
 
 	var getTextHeight = function(node) {
-		return 16;
-		// In a more modular world, this would actually read the font size, but I think leaving it a constant is sufficient for now.
-		// If you change the font size, I'd adjust this too.
+		// The crawler sizes nodes by setting data.font, so read the pixel size from the font.
+		var font = (node.data.font !== undefined) ? node.data.font : nodeFont;
+		return parseInt(font, 10) || 16;
 	};
 
 	var getImageWidth = function(node) {